@@ -32,9 +32,18 @@ func main() {
 
 		Commands: []*command.C{
 			{
-				Name:     "diff",
-				Usage:    "<db-path> <schema-path>",
-				Help:     `Compute the schema diff between a SQLite database and a SQL schema.`,
+				Name:  "diff",
+				Usage: "<db-path> <schema-path>",
+				Help: `Compute the schema diff between a SQLite database and a SQL schema.
+
+By default, the diff is printed as text. With --rule, it is rendered as an
+update rule template. With --json, the digests and changes are written as a
+JSON object on a single line, as "history --json" writes each record:
+
+   {"db":"<hex>","sql":"<hex>","changes":{...}}
+
+In all modes except --rule, the command reports an error if the schemas differ.
+`,
 				SetFlags: command.Flags(flax.MustBind, &diffFlags),
 				Run:      command.Adapt(runDiff),
 			},
@@ -61,6 +70,52 @@ The output has the form:
 				SetFlags: command.Flags(flax.MustBind, &historyFlags),
 				Run:      command.Adapt(runHistory),
 			},
+			{
+				Name:  "apply",
+				Usage: "<db-path> <migration-dir>",
+				Help: `Apply pending schema migrations to a SQLite database.
+
+The migration directory must contain a file named schema.sql with the current
+schema definition, and one file per update rule named NNN-*.sql, where NNN is
+a decimal sequence number giving the order in which rules apply. Each rule
+file must begin with a comment header giving its source and target digests:
+
+   -- Source: <hex>
+   -- Target: <hex>
+
+Digests of version 2 and later carry a version tag, as in "v2:<hex>". Use
+--digest-version to choose the version used to check the current schema.
+
+The rest of the file is executed as SQL to apply the update.
+`,
+				SetFlags: command.Flags(flax.MustBind, &applyFlags),
+				Run:      command.Adapt(runApply),
+			},
+			{
+				Name:  "plan",
+				Usage: "<db-path> <migration-dir>",
+				Help: `Report the schema migrations pending for a SQLite database.
+
+The migration directory has the same format as for the "apply" command.
+The pending updates are executed in a transaction that is always rolled back,
+to check that each rule reaches its declared target.
+`,
+				SetFlags: command.Flags(flax.MustBind, &applyFlags),
+				Run:      command.Adapt(runPlan),
+			},
+			{
+				Name:  "translate",
+				Usage: "<db-path> <migration-dir>",
+				Help: `Translate the digests in the schema history to another digest version.
+
+The migration directory has the same format as for the "apply" command. Each
+digest recorded in the schema history of the database is rewritten to the
+digest of the same schema in the version given by --digest-version, if the
+text of that schema is known.
+`,
+				SetFlags: command.Flags(flax.MustBind, &applyFlags),
+				Run:      command.Adapt(runTranslate),
+			},
 			command.HelpCommand(nil),
 			command.VersionCommand(),
 		},
@@ -69,11 +124,18 @@ The output has the form:
 }
 
 var diffFlags struct {
-	Rule   bool   `flag:"rule,Render the diff as a rule template"`
-	Ignore string `flag:"ignore-tables,Comma-separated list of tables and views to ignore when computing a diff"`
+	Rule    bool   `flag:"rule,Render the diff as a rule template"`
+	JSON    bool   `flag:"json,Write the diff as JSON, on a single line"`
+	Ignore  string `flag:"ignore-tables,Comma-separated list of tables and views to ignore when computing a diff"`
+	Prefix  string `flag:"table-prefix,Consider only tables and views with this name prefix"`
+	History string `flag:"history-table,Name of the schema history table to ignore (default _schema_history)"`
+	Version int    `flag:"digest-version,Digest algorithm version (default 1)"`
 }
 
 func runDiff(env *command.Env, dbPath, sqlPath string) error {
+	if diffFlags.Rule && diffFlags.JSON {
+		return errors.New("--rule and --json are mutually exclusive")
+	}
 	db, err := sql.Open("sqlite", dbPath)
 	if err != nil {
 		return fmt.Errorf("open db: %w", err)
@@ -82,7 +144,11 @@ func runDiff(env *command.Env, dbPath, sqlPath string) error {
 	if err != nil {
 		return err
 	}
-	var opts squibble.DigestOptions
+	opts := squibble.DigestOptions{
+		TablePrefix:  diffFlags.Prefix,
+		HistoryTable: diffFlags.History,
+		Version:      squibble.DigestVersion(diffFlags.Version),
+	}
 	if diffFlags.Ignore != "" {
 		opts.IgnoreTables = strings.Split(diffFlags.Ignore, ",")
 	}
@@ -90,7 +156,7 @@ func runDiff(env *command.Env, dbPath, sqlPath string) error {
 	if err != nil {
 		return err
 	}
-	sqlHash, err := squibble.SQLDigest(string(sql))
+	sqlHash, err := squibble.SQLDigestVersion(string(sql), opts.Version)
 	if err != nil {
 		return err
 	}
@@ -104,7 +170,12 @@ func runDiff(env *command.Env, dbPath, sqlPath string) error {
 			return fmt.Errorf("schema is identical (digest %s)", dbHash)
 		}
 
-		// Render the diff digests as Go source.
+		draft, err := squibble.DraftUpdate(env.Context(), db, string(sql), &opts)
+		if err != nil {
+			return fmt.Errorf("draft update: %w", err)
+		}
+
+		// Render the diff digests and draft update as Go source.
 		//
 		// To make the Go formatter work, we need a valid top-level declaration.
 		// here we use a variable declaration, with a stylized form that we can
@@ -114,13 +185,11 @@ func runDiff(env *command.Env, dbPath, sqlPath string) error {
 		fmt.Fprintf(&buf, `%[1]s{
         Source: %[2]q,
         Target: %[3]q,
-        Apply: func(ctx context.Context, db squibble.DBConn) error {
-          /* Schema diff:
+        /* Schema diff:
 %[4]s
-           */
-          panic("not implemented")
-        },
-      }`, prefix, dbHash, sqlHash, verr.(squibble.ValidationError).Diff)
+         */
+        Apply: %[5]s,
+      }`, prefix, dbHash, sqlHash, verr.(squibble.ValidationError).Diff, renderApply(draft))
 
 		// If this fails, it probably means the code above is wrong.
 		src, err := format.Source(buf.Bytes())
@@ -132,7 +201,26 @@ func runDiff(env *command.Env, dbPath, sqlPath string) error {
 		return nil
 	}
 
-	// Case 2: We are asked to print a diff.
+	// Case 2: We are asked to print a diff as JSON.
+	if diffFlags.JSON {
+		out := struct {
+			DB      string               `json:"db"`
+			SQL     string               `json:"sql"`
+			Changes *squibble.SchemaDiff `json:"changes,omitempty"`
+		}{DB: dbHash, SQL: sqlHash}
+		if verr != nil {
+			out.Changes = verr.(squibble.ValidationError).Changes
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(out); err != nil {
+			return err
+		}
+		if verr != nil {
+			return errors.New("schema differs")
+		}
+		return nil
+	}
+
+	// Case 3: We are asked to print a diff.
 	fmt.Println("db: ", dbHash)
 	fmt.Println("sql:", sqlHash)
 	if verr != nil {
@@ -142,9 +230,40 @@ func runDiff(env *command.Env, dbPath, sqlPath string) error {
 	return nil
 }
 
+// renderApply renders Go source for an update rule apply function that
+// executes the statements of draft. Unhandled changes are marked with TODO
+// comments.
+func renderApply(draft *squibble.UpdateDraft) string {
+	var sb strings.Builder
+	if len(draft.Stmts) == 0 {
+		sb.WriteString("func(ctx context.Context, db squibble.DBConn) error {\n")
+		for _, u := range draft.Unhandled {
+			fmt.Fprintf(&sb, "// TODO: %s\n", u)
+		}
+		sb.WriteString(`panic("not implemented")` + "\n}")
+		return sb.String()
+	}
+	sb.WriteString("squibble.Exec(\n")
+	for _, u := range draft.Unhandled {
+		fmt.Fprintf(&sb, "// TODO: %s\n", u)
+	}
+	for _, stmt := range draft.Stmts {
+		if strings.Contains(stmt, "`") {
+			fmt.Fprintf(&sb, "%q,\n", stmt)
+		} else {
+			fmt.Fprintf(&sb, "`%s`,\n", stmt)
+		}
+	}
+	sb.WriteString(")")
+	return sb.String()
+}
+
 var digestFlags struct {
-	SQL    bool   `flag:"sql,Treat input as SQL text"`
-	Ignore string `flag:"ignore-tables,Comma-separated list of tables and views to ignore when computing a diff"`
+	SQL     bool   `flag:"sql,Treat input as SQL text"`
+	Ignore  string `flag:"ignore-tables,Comma-separated list of tables and views to ignore when computing a diff"`
+	Prefix  string `flag:"table-prefix,Consider only tables and views with this name prefix"`
+	History string `flag:"history-table,Name of the schema history table to ignore (default _schema_history)"`
+	Version int    `flag:"digest-version,Digest algorithm version (default 1)"`
 }
 
 func runDigest(env *command.Env, path string) error {
@@ -157,7 +276,9 @@ func runDigest(env *command.Env, path string) error {
 }
 
 var historyFlags struct {
-	JSON bool `flag:"json,Write history records as JSON"`
+	JSON   bool   `flag:"json,Write history records as JSON, one object per line"`
+	Table  string `flag:"history-table,Name of the schema history table (default _schema_history)"`
+	Prefix string `flag:"table-prefix,Table name prefix of the schema, which sets the default history table"`
 }
 
 func runHistory(env *command.Env, dbPath string, digest ...string) error {
@@ -167,7 +288,10 @@ func runHistory(env *command.Env, dbPath string, digest ...string) error {
 	}
 	defer db.Close()
 
-	hr, err := squibble.History(env.Context(), db)
+	hr, err := squibble.ReadHistory(env.Context(), db, &squibble.DigestOptions{
+		HistoryTable: historyFlags.Table,
+		TablePrefix:  historyFlags.Prefix,
+	})
 	if err != nil {
 		return err
 	}
@@ -176,8 +300,11 @@ func runHistory(env *command.Env, dbPath string, digest ...string) error {
 			hr = hr[len(hr)-1:]
 		} else {
 			hr = slice.Partition(hr, func(r squibble.HistoryRow) bool {
+				// Match either the whole digest, or the digest without its
+				// version tag, if any.
+				_, hex, tagged := strings.Cut(r.Digest, ":")
 				for _, d := range digest {
-					if strings.HasPrefix(r.Digest, d) {
+					if strings.HasPrefix(r.Digest, d) || (tagged && strings.HasPrefix(hex, d)) {
 						return true
 					}
 				}
@@ -191,14 +318,117 @@ func runHistory(env *command.Env, dbPath string, digest ...string) error {
 		if historyFlags.JSON {
 			enc.Encode(h)
 		} else {
-			fmt.Printf("%s\t%s\t[%d bytes]\n", h.Timestamp.Format(time.RFC3339), h.Digest, len(h.Schema))
+			fmt.Printf("%s\t%s", h.Timestamp.Format(time.RFC3339), h.Digest)
+			if h.Note != "" {
+				fmt.Printf("\t(%s)", h.Note)
+			} else {
+				fmt.Printf("\t[%d bytes]", len(h.Schema))
+			}
+			if h.Elapsed > 0 {
+				fmt.Printf("\t%v", h.Elapsed)
+			}
+			if len(h.Rules) != 0 {
+				fmt.Printf("\trules %s", strings.Trim(fmt.Sprint(h.Rules), "[]"))
+			}
+			fmt.Println()
 		}
 	}
 	return nil
 }
 
+var applyFlags struct {
+	Ignore  string `flag:"ignore-tables,Comma-separated list of tables and views to ignore when computing digests"`
+	Table   string `flag:"history-table,Name of the schema history table (default _schema_history)"`
+	Prefix  string `flag:"table-prefix,Consider only tables and views with this name prefix"`
+	Version int    `flag:"digest-version,Digest algorithm version (default 1)"`
+}
+
+// loadSchema loads a schema from the migration directory dir, with the
+// settings given by applyFlags.
+func loadSchema(dir string) (*squibble.Schema, error) {
+	s, err := squibble.LoadFS(os.DirFS(dir), ".")
+	if err != nil {
+		return nil, err
+	}
+	if applyFlags.Ignore != "" {
+		s.IgnoreTables = strings.Split(applyFlags.Ignore, ",")
+	}
+	s.HistoryTable = applyFlags.Table
+	s.TablePrefix = applyFlags.Prefix
+	s.DigestVersion = squibble.DigestVersion(applyFlags.Version)
+	return s, nil
+}
+
+func runApply(env *command.Env, dbPath, dir string) error {
+	s, err := loadSchema(dir)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		return fmt.Errorf("open db: %w", err)
+	}
+	defer db.Close()
+	return s.Apply(env.Context(), db)
+}
+
+func runPlan(env *command.Env, dbPath, dir string) error {
+	s, err := loadSchema(dir)
+	if err != nil {
+		return err
+	}
+	s.Logf = func(string, ...any) {} // the plan is the output
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		return fmt.Errorf("open db: %w", err)
+	}
+	defer db.Close()
+
+	p, err := s.DryRun(env.Context(), db)
+	if p == nil {
+		return err
+	}
+	fmt.Println("plan:", p.Kind)
+	fmt.Println("db:  ", p.Source)
+	fmt.Println("sql: ", p.Target)
+	for i, u := range p.Updates {
+		fmt.Printf("[%d]\t%s -> %s\n", p.Start+i+1, u.Source, u.Target)
+	}
+	if err != nil {
+		return fmt.Errorf("dry run failed: %w", err)
+	}
+	return nil
+}
+
+func runTranslate(env *command.Env, dbPath, dir string) error {
+	s, err := loadSchema(dir)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		return fmt.Errorf("open db: %w", err)
+	}
+	defer db.Close()
+
+	n, unknown, err := s.TranslateHistory(env.Context(), db)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("translated %d history records", n)
+	if unknown != 0 {
+		fmt.Printf(" (%d with unknown schema)", unknown)
+	}
+	fmt.Println()
+	return nil
+}
+
 func loadDigest(ctx context.Context, path string) (kind, digest string, _ error) {
-	var opts squibble.DigestOptions
+	opts := squibble.DigestOptions{
+		TablePrefix:  digestFlags.Prefix,
+		HistoryTable: digestFlags.History,
+		Version:      squibble.DigestVersion(digestFlags.Version),
+	}
 	if digestFlags.Ignore != "" {
 		opts.IgnoreTables = strings.Split(digestFlags.Ignore, ",")
 	}
@@ -217,6 +447,6 @@ func loadDigest(ctx context.Context, path string) (kind, digest string, _ error)
 	if err != nil {
 		return "sql", "", err
 	}
-	d, err := squibble.SQLDigest(string(text))
+	d, err := squibble.SQLDigestVersion(string(text), opts.Version)
 	return "sql", d, err
 }
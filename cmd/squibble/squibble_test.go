@@ -0,0 +1,220 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/creachadair/command"
+	"github.com/tailscale/squibble"
+)
+
+func mustHash(t *testing.T, text string) string {
+	t.Helper()
+	h, err := squibble.SQLDigest(text)
+	if err != nil {
+		t.Fatalf("SQLDigest: %v", err)
+	}
+	return h
+}
+
+func mustWriteFile(t *testing.T, path, text string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatalf("Write file: %v", err)
+	}
+}
+
+func checkDigest(t *testing.T, dbPath, want string) {
+	t.Helper()
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("Open database: %v", err)
+	}
+	defer db.Close()
+	if got, err := squibble.DBDigest(t.Context(), db, nil); err != nil {
+		t.Fatalf("DBDigest: %v", err)
+	} else if got != want {
+		t.Errorf("DBDigest: got %s, want %s", got, want)
+	}
+}
+
+// captureStdout calls f, and returns what it writes to os.Stdout along with
+// the error it reports.
+func captureStdout(t *testing.T, f func() error) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	old := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = old }()
+
+	out := make(chan []byte)
+	go func() { data, _ := io.ReadAll(r); out <- data }()
+	ferr := f()
+	w.Close()
+	return string(<-out), ferr
+}
+
+func TestApplyPlan(t *testing.T) {
+	const v1 = `create table foo (x text);`
+	const v2 = `create table foo (x text, y text);`
+
+	env := (&command.C{Name: "test"}).NewEnv(nil)
+	dir := t.TempDir()
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	schemaPath := filepath.Join(dir, squibble.CurrentSchemaFile)
+	rulePath := filepath.Join(dir, "001-add-y.sql")
+
+	t.Run("Init", func(t *testing.T) {
+		mustWriteFile(t, schemaPath, v1)
+		if err := runPlan(env, dbPath, dir); err != nil {
+			t.Fatalf("Plan: unexpected error: %v", err)
+		}
+		if err := runApply(env, dbPath, dir); err != nil {
+			t.Fatalf("Apply: unexpected error: %v", err)
+		}
+		checkDigest(t, dbPath, mustHash(t, v1))
+	})
+
+	t.Run("BadRule", func(t *testing.T) {
+		mustWriteFile(t, schemaPath, v2)
+		mustWriteFile(t, rulePath, fmt.Sprintf("-- Source: %s\n-- Target: %s\n\nALTER TABLE foo ADD COLUMN z text;\n",
+			mustHash(t, v1), mustHash(t, v2)))
+		if err := runPlan(env, dbPath, dir); err == nil {
+			t.Error("Plan: got nil error, want dry run failure")
+		}
+		if err := runApply(env, dbPath, dir); err == nil {
+			t.Error("Apply: got nil error, want target mismatch")
+		}
+		checkDigest(t, dbPath, mustHash(t, v1))
+	})
+
+	t.Run("Upgrade", func(t *testing.T) {
+		mustWriteFile(t, rulePath, fmt.Sprintf("-- Source: %s\n-- Target: %s\n\nALTER TABLE foo ADD COLUMN y text;\n",
+			mustHash(t, v1), mustHash(t, v2)))
+		if err := runPlan(env, dbPath, dir); err != nil {
+			t.Fatalf("Plan: unexpected error: %v", err)
+		}
+		checkDigest(t, dbPath, mustHash(t, v1)) // plan does not change the database
+		if err := runApply(env, dbPath, dir); err != nil {
+			t.Fatalf("Apply: unexpected error: %v", err)
+		}
+		checkDigest(t, dbPath, mustHash(t, v2))
+	})
+
+	t.Run("MissingSchema", func(t *testing.T) {
+		if err := runApply(env, dbPath, t.TempDir()); err == nil {
+			t.Error("Apply: got nil error for a directory without a schema")
+		}
+	})
+}
+
+func TestDiffJSON(t *testing.T) {
+	const v1 = `create table foo (x text, y integer)`
+	const v2 = `create table foo (x text, y text, z text); create table bar (a integer)`
+
+	env := (&command.C{Name: "test"}).NewEnv(nil)
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "test.db")
+	sqlPath := filepath.Join(dir, "schema.sql")
+	mustWriteFile(t, sqlPath, v2)
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("Open database: %v", err)
+	}
+	if _, err := db.Exec(v1); err != nil {
+		t.Fatalf("Initialize schema: %v", err)
+	}
+	db.Close()
+
+	diffFlags.JSON = true
+	defer func() { diffFlags.JSON = false }()
+	out, err := captureStdout(t, func() error { return runDiff(env, dbPath, sqlPath) })
+	if err == nil {
+		t.Error("Diff: got nil error, want schema differs")
+	}
+	t.Logf("Output: %s", out)
+	if n := strings.Count(out, "\n"); n != 1 || !strings.HasSuffix(out, "\n") {
+		t.Errorf("Output has %d lines, want 1", n)
+	}
+
+	var got struct {
+		DB, SQL string
+		Changes *squibble.SchemaDiff
+	}
+	if err := json.Unmarshal([]byte(out), &got); err != nil {
+		t.Fatalf("Decode output: %v", err)
+	}
+	if want := mustHash(t, v1); got.DB != want {
+		t.Errorf("db: got %s, want %s", got.DB, want)
+	}
+	if want := mustHash(t, v2); got.SQL != want {
+		t.Errorf("sql: got %s, want %s", got.SQL, want)
+	}
+	if c := got.Changes; c == nil {
+		t.Fatal("changes: missing")
+	} else if len(c.Added) != 1 || c.Added[0].Type != "table" || c.Added[0].Name != "bar" {
+		t.Errorf("changes: got added %+v, want table bar", c.Added)
+	} else if len(c.Modified) != 1 || c.Modified[0].Name != "foo" {
+		t.Errorf("changes: got modified %+v, want table foo", c.Modified)
+	} else {
+		cols := make(map[string]squibble.ColumnChange)
+		for _, cc := range c.Modified[0].Columns {
+			cols[cc.Name] = cc
+		}
+		if y, ok := cols["y"]; !ok || y.Old == nil || y.New == nil || y.Old.Type != "INTEGER" || y.New.Type != "TEXT" {
+			t.Errorf("changes: got column y %+v, want type INTEGER to TEXT", y)
+		}
+		if z, ok := cols["z"]; !ok || z.Old != nil || z.New == nil {
+			t.Errorf("changes: got column z %+v, want added", z)
+		}
+	}
+}
+
+func TestHistoryTableFlag(t *testing.T) {
+	const v1 = `create table foo (x text)`
+
+	env := (&command.C{Name: "test"}).NewEnv(nil)
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "test.db")
+	sqlPath := filepath.Join(dir, "schema.sql")
+	mustWriteFile(t, sqlPath, v1)
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("Open database: %v", err)
+	}
+	s := &squibble.Schema{Current: v1, HistoryTable: "hist", Logf: t.Logf}
+	if err := s.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply: unexpected error: %v", err)
+	}
+	db.Close()
+
+	// Without the flag, the history table is part of the schema.
+	if _, err := captureStdout(t, func() error { return runDiff(env, dbPath, sqlPath) }); err == nil {
+		t.Error("Diff: got nil error, want schema differs")
+	}
+
+	diffFlags.History, digestFlags.History = "hist", "hist"
+	defer func() { diffFlags.History, digestFlags.History = "", "" }()
+	if out, err := captureStdout(t, func() error { return runDiff(env, dbPath, sqlPath) }); err != nil {
+		t.Errorf("Diff: unexpected error: %v\n%s", err, out)
+	}
+	out, err := captureStdout(t, func() error { return runDigest(env, dbPath) })
+	if err != nil {
+		t.Fatalf("Digest: unexpected error: %v", err)
+	}
+	if want := "db: " + mustHash(t, v1) + "\n"; out != want {
+		t.Errorf("Digest: got %q, want %q", out, want)
+	}
+}
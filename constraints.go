@@ -0,0 +1,391 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package squibble
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// readConstraints fills in the constraints of the table described by r, and
+// the collations of its columns, as recorded by DigestV2.
+//
+// The column metadata reported by SQLite do not include CHECK and UNIQUE
+// constraints, collations, or table options, so these are parsed from the
+// SQL text of the table. Foreign keys are read from the database.
+func readConstraints(ctx context.Context, db DBConn, root string, r *schemaRow) error {
+	tc := parseCreateTable(r.SQL)
+	for col, coll := range tc.collate {
+		i := slices.IndexFunc(r.Columns, func(c schemaCol) bool { return strings.EqualFold(c.Name, col) })
+		if i >= 0 {
+			r.Columns[i].Collate = coll
+		}
+	}
+	fks, err := readForeignKeys(ctx, db, root, r.Name)
+	if err != nil {
+		return err
+	}
+	r.Constraints = append(tc.constraints, fks...)
+	slices.Sort(r.Constraints)
+	r.Constraints = slices.Compact(r.Constraints)
+	return nil
+}
+
+// readForeignKeys reads the foreign key constraints of the specified table,
+// rendered in a canonical form.
+func readForeignKeys(ctx context.Context, db DBConn, root, table string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`PRAGMA %s.foreign_key_list('%s')`, quoteIdent(root), table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type fkey struct {
+		parent             string
+		from, to           []string
+		onUpdate, onDelete string
+		match              string
+	}
+	var keys []*fkey
+	byID := make(map[int]*fkey)
+	for rows.Next() {
+		var id, seq int
+		var parent, from, onUpdate, onDelete, match string
+		var to sql.NullString
+		if err := rows.Scan(&id, &seq, &parent, &from, &to, &onUpdate, &onDelete, &match); err != nil {
+			return nil, fmt.Errorf("scan %s foreign keys: %w", table, err)
+		}
+		fk, ok := byID[id]
+		if !ok {
+			fk = &fkey{parent: parent, onUpdate: onUpdate, onDelete: onDelete, match: match}
+			byID[id] = fk
+			keys = append(keys, fk)
+		}
+		fk.from = append(fk.from, quoteIdent(from))
+		if to.Valid {
+			fk.to = append(fk.to, quoteIdent(to.String))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read %s foreign keys: %w", table, err)
+	}
+
+	var out []string
+	for _, fk := range keys {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "FOREIGN KEY (%s) REFERENCES %s", strings.Join(fk.from, ", "), quoteIdent(fk.parent))
+		if len(fk.to) != 0 {
+			fmt.Fprintf(&sb, " (%s)", strings.Join(fk.to, ", "))
+		}
+		if fk.onUpdate != "NO ACTION" {
+			fmt.Fprintf(&sb, " ON UPDATE %s", fk.onUpdate)
+		}
+		if fk.onDelete != "NO ACTION" {
+			fmt.Fprintf(&sb, " ON DELETE %s", fk.onDelete)
+		}
+		if fk.match != "NONE" {
+			fmt.Fprintf(&sb, " MATCH %s", fk.match)
+		}
+		out = append(out, sb.String())
+	}
+	return out, nil
+}
+
+// createTableInfo records the properties of a table parsed from the text of
+// its CREATE TABLE statement.
+type createTableInfo struct {
+	constraints []string          // CHECK and UNIQUE constraints, and table options
+	collate     map[string]string // column name → collation
+}
+
+// parseCreateTable parses the CHECK and UNIQUE constraints, column
+// collations, and table options from the CREATE TABLE statement stmt. Each
+// constraint is rendered in a canonical form, so that equivalent spellings of
+// a constraint compare equal. Foreign keys and primary keys are not recorded,
+// since SQLite reports those separately. Virtual tables have none of these
+// properties.
+func parseCreateTable(stmt string) createTableInfo {
+	out := createTableInfo{collate: make(map[string]string)}
+	toks := sqlTokens(stmt)
+	if len(toks) > 1 && strings.EqualFold(toks[1], "VIRTUAL") {
+		return out
+	}
+	start := slices.Index(toks, "(")
+	if start < 0 {
+		return out
+	}
+	end := matchParen(toks, start)
+
+	// Table options follow the column definitions.
+	for _, opt := range splitTokens(toks[end+1:], ",") {
+		if len(opt) != 0 {
+			out.constraints = append(out.constraints, canonicalSQL(opt))
+		}
+	}
+
+	for _, def := range splitTokens(toks[start+1:end], ",") {
+		if len(def) == 0 {
+			continue
+		}
+		switch strings.ToUpper(def[0]) {
+		case "CONSTRAINT", "CHECK", "UNIQUE":
+			// A table constraint.
+			for _, c := range columnConstraints(def) {
+				if c[0] == "CHECK" || c[0] == "UNIQUE" {
+					out.constraints = append(out.constraints, canonicalSQL(c))
+				}
+			}
+			continue
+		case "PRIMARY", "FOREIGN":
+			continue // reported by SQLite
+		}
+
+		// A column definition: The name, an optional type, and constraints.
+		name := unquoteIdent(def[0])
+		for _, c := range columnConstraints(def) {
+			switch c[0] {
+			case "CHECK":
+				out.constraints = append(out.constraints, canonicalSQL(c))
+			case "UNIQUE":
+				// Render as the equivalent table constraint, keeping the
+				// conflict clause (ON CONFLICT ...), if any.
+				uc := append([]string{"UNIQUE", "(", def[0], ")"}, c[1:]...)
+				out.constraints = append(out.constraints, canonicalSQL(uc))
+			case "COLLATE":
+				if len(c) > 1 {
+					if coll := strings.ToUpper(unquoteIdent(c[1])); coll != "BINARY" {
+						out.collate[name] = coll
+					}
+				}
+			}
+		}
+	}
+	return out
+}
+
+// columnConstraints splits the tokens of a column definition or table
+// constraint into its constraints, each beginning with an upper-cased keyword
+// such as "CHECK" or "COLLATE". Constraint names are discarded.
+func columnConstraints(def []string) [][]string {
+	var out [][]string
+	for i := 0; i < len(def); i++ {
+		switch kw := strings.ToUpper(def[i]); kw {
+		case "CONSTRAINT":
+			i++ // skip the name
+		case "CHECK", "UNIQUE", "COLLATE", "PRIMARY", "NOT", "NULL", "DEFAULT",
+			"REFERENCES", "GENERATED", "AS":
+			out = append(out, []string{kw})
+		default:
+			if len(out) != 0 {
+				out[len(out)-1] = append(out[len(out)-1], def[i])
+			}
+		}
+		if i < len(def) && def[i] == "(" && len(out) != 0 {
+			// Keep parenthesized groups together, so that keywords inside
+			// expressions are not mistaken for constraints.
+			end := matchParen(def, i)
+			out[len(out)-1] = append(out[len(out)-1], def[i+1:end+1]...)
+			i = end
+		}
+	}
+	return out
+}
+
+// canonicalSQL renders toks in a canonical form: Tokens are separated by
+// single spaces, except inside parentheses, before commas, and around
+// periods, and identifiers and keywords are converted to upper case.
+func canonicalSQL(toks []string) string {
+	var sb strings.Builder
+	for i, tok := range toks {
+		if i > 0 && toks[i-1] != "(" && toks[i-1] != "." && tok != ")" && tok != "," && tok != "." {
+			sb.WriteByte(' ')
+		}
+		switch tok[0] {
+		case '\'':
+			sb.WriteString(tok) // a string literal
+		case '"', '`', '[':
+			if id := unquoteIdent(tok); isSimpleIdent(id) {
+				sb.WriteString(strings.ToUpper(id))
+			} else {
+				sb.WriteString(quoteIdent(id))
+			}
+		default:
+			sb.WriteString(strings.ToUpper(tok))
+		}
+	}
+	return sb.String()
+}
+
+// isSimpleIdent reports whether s can be written as an identifier without
+// quotation.
+func isSimpleIdent(s string) bool {
+	for i, c := range s {
+		if !(c == '_' || unicode.IsLetter(c) || (i > 0 && unicode.IsDigit(c))) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// unquoteIdent removes the quotation from an identifier token, if any.
+func unquoteIdent(tok string) string {
+	if len(tok) < 2 {
+		return tok
+	}
+	switch q := tok[0]; q {
+	case '"', '`', '\'':
+		return strings.ReplaceAll(tok[1:len(tok)-1], string([]byte{q, q}), string(q))
+	case '[':
+		return tok[1 : len(tok)-1]
+	}
+	return tok
+}
+
+// matchParen returns the offset in toks of the parenthesis closing the one at
+// offset start, or len(toks)-1 if it is not closed.
+func matchParen(toks []string, start int) int {
+	depth := 0
+	for i := start; i < len(toks); i++ {
+		switch toks[i] {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(toks) - 1
+}
+
+// splitTokens splits toks at each occurrence of sep outside parentheses.
+func splitTokens(toks []string, sep string) [][]string {
+	var out [][]string
+	var cur []string
+	for i := 0; i < len(toks); i++ {
+		if toks[i] == sep {
+			out = append(out, cur)
+			cur = nil
+			continue
+		}
+		cur = append(cur, toks[i])
+		if toks[i] == "(" {
+			end := matchParen(toks, i)
+			cur = append(cur, toks[i+1:end+1]...)
+			i = end
+		}
+	}
+	return append(out, cur)
+}
+
+// twoCharOps are the SQL operators spelled with two characters.
+var twoCharOps = []string{"<=", ">=", "!=", "==", "<>", "||", "<<", ">>", "->"}
+
+// sqlTokens splits the SQL text s into tokens, discarding whitespace and
+// comments. Quoted strings and identifiers are each a single token, including
+// their quotation marks. This is not a full SQL lexer, but it suffices to
+// find the boundaries of definitions and constraints.
+func sqlTokens(s string) []string {
+	var out []string
+	scanTokens(s, func(i, j int) { out = append(out, s[i:j]) })
+	return out
+}
+
+// scanTokens calls f with the offsets of each token of the SQL text s in
+// order, as split by [sqlTokens].
+func scanTokens(s string, f func(i, j int)) {
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			i++
+		case strings.HasPrefix(s[i:], "--"):
+			if j := strings.IndexByte(s[i:], '\n'); j >= 0 {
+				i += j + 1
+			} else {
+				i = len(s)
+			}
+		case strings.HasPrefix(s[i:], "/*"):
+			if j := strings.Index(s[i+2:], "*/"); j >= 0 {
+				i += j + 4
+			} else {
+				i = len(s)
+			}
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			closer := c
+			if c == '[' {
+				closer = ']'
+			}
+			j := i + 1
+			for j < len(s) {
+				if s[j] == closer {
+					if closer != ']' && j+1 < len(s) && s[j+1] == closer {
+						j += 2 // a doubled quotation mark
+						continue
+					}
+					break
+				}
+				j++
+			}
+			end := min(j+1, len(s))
+			f(i, end)
+			i = end
+		case isWordByte(c):
+			j := i
+			for j < len(s) && isWordByte(s[j]) {
+				j++
+			}
+			f(i, j)
+			i = j
+		default:
+			n := 1
+			if slices.ContainsFunc(twoCharOps, func(op string) bool { return strings.HasPrefix(s[i:], op) }) {
+				n = 2
+			}
+			f(i, i+n)
+			i += n
+		}
+	}
+}
+
+// splitStatements splits the SQL script s into its statements, each with its
+// terminating semicolon, if any, and any comments preceding it. Text holding
+// no tokens, such as trailing comments, is omitted. The semicolons within the
+// body of a CREATE TRIGGER statement do not end the statement.
+func splitStatements(s string) []string {
+	var out []string
+	var start, depth int // offset of the current statement, nesting of BEGIN/CASE...END
+	var toks []string    // tokens of the current statement, upper-cased
+	scanTokens(s, func(i, j int) {
+		tok := strings.ToUpper(s[i:j])
+		toks = append(toks, tok)
+		isTrigger := toks[0] == "CREATE" && slices.Contains(toks[1:min(len(toks), 3)], "TRIGGER")
+		switch {
+		case tok == ";" && depth == 0:
+			out = append(out, s[start:j])
+			start, toks = j, nil
+		case !isTrigger:
+		case tok == "BEGIN" || tok == "CASE":
+			depth++
+		case tok == "END":
+			depth--
+		}
+	})
+	if len(toks) != 0 {
+		out = append(out, s[start:])
+	}
+	return out
+}
+
+// isWordByte reports whether c can be part of a keyword, unquoted
+// identifier, or numeric literal.
+func isWordByte(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 ||
+		('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
@@ -0,0 +1,279 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package squibble
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// A SchemaDiff describes the differences between two SQLite schemas, an old
+// schema (the "left" side) and a new schema (the "right" side). Its String
+// method renders a human-readable summary of the differences.
+type SchemaDiff struct {
+	Added    []SchemaObject `json:"added,omitempty"`    // objects only in the new schema
+	Removed  []SchemaObject `json:"removed,omitempty"`  // objects only in the old schema
+	Modified []ObjectChange `json:"modified,omitempty"` // objects in both, but different
+}
+
+// IsEmpty reports whether d contains no differences.
+func (d *SchemaDiff) IsEmpty() bool {
+	return d == nil || (len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0)
+}
+
+// isAdditive reports whether the changes in d only add to the old schema, so
+// that programs using the old schema can use the new one. Objects may be
+// added, and columns may be added to tables if they are nullable or have a
+// default value. Nothing may be removed or modified.
+func (d *SchemaDiff) isAdditive() bool {
+	if len(d.Removed) != 0 {
+		return false
+	}
+	for _, m := range d.Modified {
+		if m.Type != "table" || len(m.AddedConstraints) != 0 || len(m.RemovedConstraints) != 0 {
+			return false
+		}
+		for _, c := range m.Columns {
+			if c.Old != nil || (c.New.NotNull && c.New.Default == nil && c.New.Hidden == 0) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// A SchemaObject describes a table, index, view, or trigger in a schema.
+type SchemaObject struct {
+	Type    string   `json:"type"`              // e.g., "index", "table", "trigger", "view"
+	Name    string   `json:"name"`              // the name of the object
+	Table   string   `json:"table,omitempty"`   // affiliated table name (== Name for tables and views)
+	Columns []Column `json:"columns,omitempty"` // for tables, the columns
+	SQL     string   `json:"sql,omitempty"`     // the text of the definition
+}
+
+// A Column describes a column of a table in a schema.
+type Column struct {
+	Name       string `json:"name"`                 // column name
+	Type       string `json:"type"`                 // type description, normalized to upper case
+	NotNull    bool   `json:"notNull,omitempty"`    // whether the column is marked NOT NULL
+	Default    any    `json:"default,omitempty"`    // the default value, as written (nil if none)
+	PrimaryKey bool   `json:"primaryKey,omitempty"` // whether this column is part of the primary key
+	Hidden     int    `json:"hidden,omitempty"`     // 0=normal, 1=hidden, 2=generated virtual, 3=generated stored
+	Collate    string `json:"collate,omitempty"`    // the collation, if not BINARY (DigestV2 and later)
+}
+
+func (c Column) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%q %s", c.Name, c.Type)
+	if c.NotNull {
+		fmt.Fprint(&sb, " not null")
+	} else {
+		fmt.Fprint(&sb, " null")
+	}
+	if c.Default != nil {
+		fmt.Fprintf(&sb, " default=%v", c.Default)
+	}
+	if c.PrimaryKey {
+		fmt.Fprint(&sb, " primary key")
+	}
+	if c.Collate != "" {
+		fmt.Fprintf(&sb, " collate %s", c.Collate)
+	}
+	return sb.String()
+}
+
+// An ObjectChange describes an object present in both schemas of a
+// [SchemaDiff] whose definition differs.
+type ObjectChange struct {
+	Type   string `json:"type"`             // e.g., "index", "table", "trigger", "view"
+	Name   string `json:"name"`             // the name of the object
+	Table  string `json:"table,omitempty"`  // affiliated table name
+	OldSQL string `json:"oldSQL,omitempty"` // the old definition
+	NewSQL string `json:"newSQL,omitempty"` // the new definition
+
+	// For tables, the changes to individual columns.
+	Columns []ColumnChange `json:"columns,omitempty"`
+
+	// For tables, the constraints and table options (such as "STRICT") that
+	// are only in the new or the old schema, in canonical form. These are
+	// compared only for digest versions DigestV2 and later.
+	AddedConstraints   []string `json:"addedConstraints,omitempty"`
+	RemovedConstraints []string `json:"removedConstraints,omitempty"`
+}
+
+// A ColumnChange describes a change to a single column of a table.
+// Columns are matched by name.
+type ColumnChange struct {
+	Name string  `json:"name"`          // the name of the column
+	Old  *Column `json:"old,omitempty"` // the old column, nil if the column was added
+	New  *Column `json:"new,omitempty"` // the new column, nil if the column was removed
+
+	// Changed lists which properties of a modified column differ, from among
+	// "type", "notNull", "default", "primaryKey", "hidden", and "collate".
+	// It is empty for added and removed columns.
+	Changed []string `json:"changed,omitempty"`
+}
+
+// DiffSQL computes the differences between the schemas defined by the SQL
+// texts oldSQL and newSQL. It compares all the properties recorded by the
+// latest digest version.
+func DiffSQL(oldSQL, newSQL string) (*SchemaDiff, error) {
+	ctx := context.Background()
+	lhs, err := schemaTextToRows(ctx, oldSQL, DigestV2)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := schemaTextToRows(ctx, newSQL, DigestV2)
+	if err != nil {
+		return nil, err
+	}
+	return newSchemaDiff(lhs, rhs), nil
+}
+
+// DiffDB computes the differences between the schema of db (old) and the
+// schema defined by the SQL text of schema (new). A nil opts is valid and
+// provides default options.
+func DiffDB(ctx context.Context, db DBConn, schema string, opts *DigestOptions) (*SchemaDiff, error) {
+	comp, err := schemaTextToRows(ctx, schema, opts.version())
+	if err != nil {
+		return nil, err
+	}
+	main, err := readSchema(ctx, db, opts)
+	if err != nil {
+		return nil, err
+	}
+	return newSchemaDiff(main, comp), nil
+}
+
+// newSchemaDiff computes the differences from ar to br, which must be sorted
+// as by readSchema.
+func newSchemaDiff(ar, br []schemaRow) *SchemaDiff {
+	lhs := make(map[mapKey]schemaRow)
+	for _, r := range ar {
+		lhs[r.mapKey()] = r
+	}
+	rhs := make(map[mapKey]schemaRow)
+	for _, r := range br {
+		rhs[r.mapKey()] = r
+	}
+
+	d := new(SchemaDiff)
+	for _, r := range ar {
+		o, ok := rhs[r.mapKey()]
+		if !ok {
+			d.Removed = append(d.Removed, r.object())
+			continue
+		}
+
+		// Indices and views do not have columns, so diff those using their
+		// normalized SQL representation.
+		if len(r.Columns) == 0 && len(o.Columns) == 0 {
+			if cleanSQL(r.SQL) != cleanSQL(o.SQL) {
+				d.Modified = append(d.Modified, ObjectChange{
+					Type: r.Type, Name: r.Name, Table: r.TableName, OldSQL: r.SQL, NewSQL: o.SQL,
+				})
+			}
+			continue
+		}
+
+		// For tables, diff the columns and constraints.
+		cc := diffColumns(r.Columns, o.Columns)
+		added, removed := diffStrings(r.Constraints, o.Constraints)
+		if len(cc) != 0 || len(added) != 0 || len(removed) != 0 {
+			d.Modified = append(d.Modified, ObjectChange{
+				Type: r.Type, Name: r.Name, Table: r.TableName, OldSQL: r.SQL, NewSQL: o.SQL, Columns: cc,
+				AddedConstraints: added, RemovedConstraints: removed,
+			})
+		}
+	}
+	for _, r := range br {
+		if _, ok := lhs[r.mapKey()]; ok {
+			continue // we already dealt with this above
+		}
+		d.Added = append(d.Added, r.object())
+	}
+	return d
+}
+
+// diffColumns computes the changes from the columns in lhs to rhs, matching
+// them by name. Modified and removed columns are reported first, in the order
+// of lhs, followed by added columns in the order of rhs.
+func diffColumns(lhs, rhs []schemaCol) []ColumnChange {
+	var out []ColumnChange
+	for _, a := range lhs {
+		i := slices.IndexFunc(rhs, func(c schemaCol) bool { return c.Name == a.Name })
+		if i < 0 {
+			out = append(out, ColumnChange{Name: a.Name, Old: a.column()})
+			continue
+		}
+		b := rhs[i]
+		if a == b {
+			continue
+		}
+		cc := ColumnChange{Name: a.Name, Old: a.column(), New: b.column()}
+		if a.Type != b.Type {
+			cc.Changed = append(cc.Changed, "type")
+		}
+		if a.NotNull != b.NotNull {
+			cc.Changed = append(cc.Changed, "notNull")
+		}
+		if a.Default != b.Default {
+			cc.Changed = append(cc.Changed, "default")
+		}
+		if a.PrimaryKey != b.PrimaryKey {
+			cc.Changed = append(cc.Changed, "primaryKey")
+		}
+		if a.Hidden != b.Hidden {
+			cc.Changed = append(cc.Changed, "hidden")
+		}
+		if a.Collate != b.Collate {
+			cc.Changed = append(cc.Changed, "collate")
+		}
+		out = append(out, cc)
+	}
+	for _, b := range rhs {
+		if !slices.ContainsFunc(lhs, func(c schemaCol) bool { return c.Name == b.Name }) {
+			out = append(out, ColumnChange{Name: b.Name, New: b.column()})
+		}
+	}
+	return out
+}
+
+// diffStrings reports the strings only in rhs (added) and only in lhs
+// (removed), each in their original order.
+func diffStrings(lhs, rhs []string) (added, removed []string) {
+	for _, b := range rhs {
+		if !slices.Contains(lhs, b) {
+			added = append(added, b)
+		}
+	}
+	for _, a := range lhs {
+		if !slices.Contains(rhs, a) {
+			removed = append(removed, a)
+		}
+	}
+	return added, removed
+}
+
+func (s schemaRow) object() SchemaObject {
+	obj := SchemaObject{Type: s.Type, Name: s.Name, Table: s.TableName, SQL: s.SQL}
+	for _, c := range s.Columns {
+		obj.Columns = append(obj.Columns, *c.column())
+	}
+	return obj
+}
+
+func (c schemaCol) column() *Column {
+	return &Column{
+		Name:       c.Name,
+		Type:       c.Type,
+		NotNull:    c.NotNull,
+		Default:    c.Default,
+		PrimaryKey: c.PrimaryKey,
+		Hidden:     c.Hidden,
+		Collate:    c.Collate,
+	}
+}
@@ -0,0 +1,433 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package squibble
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/creachadair/mds/mapset"
+)
+
+// An UpdateDraft is a best-effort sequence of SQL statements to update one
+// schema to another, as generated by [DraftUpdate].
+type UpdateDraft struct {
+	// Stmts are the SQL statements to execute, in order.
+	Stmts []string
+
+	// Unhandled describes changes that could not be expressed as statements.
+	// If it is not empty, Stmts are not sufficient to complete the update.
+	Unhandled []string
+}
+
+// DraftUpdate generates a draft of the SQL statements needed to update the
+// schema of db to the schema defined by the SQL text of schema. A nil opts is
+// valid and provides default options.
+//
+// Indexes, views, and triggers are dropped and created as needed. Columns are
+// added, dropped, and renamed with ALTER TABLE where SQLite permits. Other
+// changes to a table, such as changes to the type or constraints of an
+// existing column, are handled by rebuilding the table following the
+// procedure described in https://sqlite.org/lang_altertable.html#otheralter.
+// Renames are inferred when a removed table or column is identical to an
+// added one except for its name. Since a rename cannot be distinguished from
+// a drop and an add, which lose the data of the removed table or column, the
+// statement for each inferred rename begins with a "-- verify: inferred
+// rename" comment. After rebuilding a table, the draft checks its foreign
+// key constraints with PRAGMA foreign_key_check (see [Exec]).
+//
+// The resulting statements should be reviewed before use.
+func DraftUpdate(ctx context.Context, db DBConn, schema string, opts *DigestOptions) (*UpdateDraft, error) {
+	comp, err := schemaTextToRows(ctx, schema, opts.version())
+	if err != nil {
+		return nil, err
+	}
+	main, err := readSchema(ctx, db, opts)
+	if err != nil {
+		return nil, err
+	}
+	return draftUpdate(main, comp), nil
+}
+
+func draftUpdate(ar, br []schemaRow) *UpdateDraft {
+	diff := newSchemaDiff(ar, br)
+	dr := &draftState{UpdateDraft: new(UpdateDraft), dropped: mapset.New[mapKey](), created: mapset.New[mapKey]()}
+
+	// Infer renamed tables, and set them aside so they are not dropped and
+	// re-created below.
+	var renames [][2]string
+	removed, added := slices.Clone(diff.Removed), slices.Clone(diff.Added)
+	for i := 0; i < len(removed); i++ {
+		r := removed[i]
+		if r.Type != "table" {
+			continue
+		}
+		j, ok := uniqueMatch(added, func(a SchemaObject) bool {
+			return a.Type == "table" && slices.Equal(a.Columns, r.Columns)
+		})
+		if !ok {
+			continue
+		}
+		renames = append(renames, [2]string{r.Name, added[j].Name})
+		removed = slices.Delete(removed, i, i+1)
+		added = slices.Delete(added, j, j+1)
+		i--
+	}
+
+	// Plan the changes to modified tables, noting which of them require a
+	// rebuild.
+	var tables []tableChange
+	var rebuilt []string
+	for _, m := range diff.Modified {
+		if m.Type == "table" {
+			tc := newTableChange(m)
+			if tc.needsRebuild() {
+				rebuilt = append(rebuilt, tc.Name)
+			}
+			tables = append(tables, tc)
+		}
+	}
+	var dependents []schemaRow
+	if len(rebuilt) != 0 {
+		dependents = dependentObjects(ar, rebuilt...)
+	}
+
+	// Step 1: Drop triggers, views, and indexes that are removed or modified.
+	// Also drop the views and triggers that refer to a table that must be
+	// rebuilt, since the old table cannot be dropped while they exist.
+	for _, kind := range []string{"trigger", "view", "index"} {
+		for _, r := range removed {
+			if r.Type == kind {
+				dr.drop(r.Type, r.Name)
+			}
+		}
+		for _, m := range diff.Modified {
+			if m.Type == kind {
+				dr.drop(m.Type, m.Name)
+			}
+		}
+		if kind != "index" {
+			for _, r := range dependents {
+				if r.Type == kind {
+					dr.drop(r.Type, r.Name)
+				}
+			}
+		}
+	}
+
+	// Step 2: Rename, drop, and create whole tables.
+	for _, rn := range renames {
+		dr.add(verifyRename("table", rn) +
+			fmt.Sprintf(`ALTER TABLE %s RENAME TO %s`, quoteIdent(rn[0]), quoteIdent(rn[1])))
+	}
+	for _, r := range removed {
+		if r.Type == "table" {
+			dr.drop(r.Type, r.Name)
+		}
+	}
+	for _, a := range added {
+		if a.Type == "table" {
+			dr.create(a.Type, a.Name, a.SQL)
+		}
+	}
+
+	// Step 3: Update modified tables, in place where possible.
+	for _, tc := range tables {
+		if tc.needsRebuild() {
+			dr.rebuild(tc, br)
+		} else {
+			dr.alter(tc)
+		}
+	}
+
+	// Step 4: Create indexes, views, and triggers that are new or modified,
+	// or that were dropped above to permit a rebuild.
+	for _, kind := range []string{"index", "view", "trigger"} {
+		for _, r := range br {
+			if r.Type != kind {
+				continue
+			}
+			isNew := slices.ContainsFunc(added, func(a SchemaObject) bool {
+				return a.Type == r.Type && a.Name == r.Name
+			})
+			if isNew || dr.dropped.Has(r.mapKey()) {
+				dr.create(r.Type, r.Name, r.SQL)
+			}
+		}
+	}
+	return dr.UpdateDraft
+}
+
+// A tableChange records the column changes to a modified table.
+type tableChange struct {
+	*ObjectChange
+	renames  [][2]string // old, new
+	drops    []Column
+	adds     []Column
+	modified []ColumnChange
+}
+
+func newTableChange(m ObjectChange) tableChange {
+	tc := tableChange{ObjectChange: &m}
+	for _, c := range m.Columns {
+		switch {
+		case c.Old != nil && c.New != nil:
+			tc.modified = append(tc.modified, c)
+		case c.New == nil:
+			tc.drops = append(tc.drops, *c.Old)
+		default:
+			tc.adds = append(tc.adds, *c.New)
+		}
+	}
+
+	// Infer renames: A dropped column that uniquely matches an added column
+	// except for its name.
+	for i := 0; i < len(tc.drops); i++ {
+		old := tc.drops[i]
+		j, ok := uniqueMatch(tc.adds, func(c Column) bool {
+			c.Name = old.Name
+			return c == old
+		})
+		if !ok {
+			continue
+		}
+		tc.renames = append(tc.renames, [2]string{old.Name, tc.adds[j].Name})
+		tc.drops = slices.Delete(tc.drops, i, i+1)
+		tc.adds = slices.Delete(tc.adds, j, j+1)
+		i--
+	}
+	return tc
+}
+
+// needsRebuild reports whether the changes to tc cannot be made in place
+// with ALTER TABLE.
+func (tc tableChange) needsRebuild() bool {
+	if len(tc.modified) != 0 || len(tc.AddedConstraints) != 0 || len(tc.RemovedConstraints) != 0 {
+		return true
+	}
+	for _, c := range tc.drops {
+		if c.PrimaryKey || c.Hidden != 0 {
+			return true
+		}
+	}
+	for _, c := range tc.adds {
+		if !canAddColumn(c) {
+			return true
+		}
+	}
+	return false
+}
+
+type draftState struct {
+	*UpdateDraft
+	dropped mapset.Set[mapKey]
+	created mapset.Set[mapKey]
+}
+
+func (d *draftState) add(stmt string) { d.Stmts = append(d.Stmts, stmt) }
+
+func (d *draftState) drop(kind, name string) {
+	if d.dropped.Has(mapKey{kind, name}) {
+		return
+	}
+	d.dropped.Add(mapKey{kind, name})
+	d.add(fmt.Sprintf(`DROP %s %s`, strings.ToUpper(kind), quoteIdent(name)))
+}
+
+func (d *draftState) create(kind, name, sql string) {
+	if sql == "" || d.created.Has(mapKey{kind, name}) {
+		return // e.g., automatic indexes have no SQL
+	}
+	d.created.Add(mapKey{kind, name})
+	d.add(sql)
+}
+
+func (d *draftState) unhandled(msg string, args ...any) {
+	d.Unhandled = append(d.Unhandled, fmt.Sprintf(msg, args...))
+}
+
+// alter adds ALTER TABLE statements to apply the changes of tc in place.
+func (d *draftState) alter(tc tableChange) {
+	tab := quoteIdent(tc.Name)
+	for _, rn := range tc.renames {
+		d.add(verifyRename("column", rn) +
+			fmt.Sprintf(`ALTER TABLE %s RENAME COLUMN %s TO %s`, tab, quoteIdent(rn[0]), quoteIdent(rn[1])))
+	}
+	for _, c := range tc.drops {
+		d.add(fmt.Sprintf(`ALTER TABLE %s DROP COLUMN %s`, tab, quoteIdent(c.Name)))
+	}
+	for _, c := range tc.adds {
+		def, ok := columnDefText(tc.NewSQL, c.Name)
+		if !ok {
+			def = columnDef(c)
+		}
+		d.add(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s`, tab, def))
+	}
+}
+
+// rebuild adds statements to rebuild the table described by tc, and to
+// re-create its indexes and triggers from the target schema br.
+func (d *draftState) rebuild(tc tableChange, br []schemaRow) {
+	tmp := "_squibble_new_" + tc.Name
+	create, ok := renameCreateTable(tc.NewSQL, quoteIdent(tmp))
+	if !ok {
+		d.unhandled("cannot rebuild table %q: unsupported definition", tc.Name)
+		return
+	}
+	for _, c := range tc.adds {
+		if c.NotNull && c.Default == nil && c.Hidden == 0 {
+			d.unhandled("table %q: new column %q is NOT NULL without a default", tc.Name, c.Name)
+		}
+	}
+
+	// Copy all the columns that exist in both versions of the table, taking
+	// renames into account. Generated columns are not copied.
+	var src, dst []string
+	for _, c := range tc.modified {
+		if c.Old.Hidden == 0 && c.New.Hidden == 0 {
+			src = append(src, quoteIdent(c.Name))
+			dst = append(dst, quoteIdent(c.Name))
+		}
+	}
+	for _, rn := range tc.renames {
+		src = append(src, quoteIdent(rn[0]))
+		dst = append(dst, quoteIdent(rn[1]))
+	}
+	for _, r := range br {
+		if r.Type != "table" || r.Name != tc.Name {
+			continue
+		}
+		for _, c := range r.Columns {
+			if c.Hidden == 0 && !slices.ContainsFunc(tc.Columns, func(cc ColumnChange) bool { return cc.Name == c.Name }) {
+				src = append(src, quoteIdent(c.Name)) // unchanged
+				dst = append(dst, quoteIdent(c.Name))
+			}
+		}
+	}
+
+	d.add(create)
+	if len(src) != 0 {
+		var verify string
+		for _, rn := range tc.renames {
+			verify += verifyRename("column", rn)
+		}
+		d.add(verify + fmt.Sprintf(`INSERT INTO %s (%s) SELECT %s FROM %s`,
+			quoteIdent(tmp), strings.Join(dst, ", "), strings.Join(src, ", "), quoteIdent(tc.Name)))
+	}
+	d.add(fmt.Sprintf(`DROP TABLE %s`, quoteIdent(tc.Name)))
+	d.add(fmt.Sprintf(`ALTER TABLE %s RENAME TO %s`, quoteIdent(tmp), quoteIdent(tc.Name)))
+	for _, r := range br {
+		if r.TableName == tc.Name && (r.Type == "index" || r.Type == "trigger") {
+			d.create(r.Type, r.Name, r.SQL)
+		}
+	}
+	d.add(fmt.Sprintf(`PRAGMA foreign_key_check(%s)`, quoteIdent(tc.Name)))
+}
+
+// verifyRename returns a comment line marking a statement that relies on the
+// inferred rename of a table or column from rn[0] to rn[1].
+func verifyRename(kind string, rn [2]string) string {
+	return fmt.Sprintf("-- verify: inferred rename of %s %s to %s\n", kind, quoteIdent(rn[0]), quoteIdent(rn[1]))
+}
+
+// canAddColumn reports whether c can be added to an existing table using
+// ALTER TABLE ... ADD COLUMN.  See https://sqlite.org/lang_altertable.html.
+func canAddColumn(c Column) bool {
+	if c.PrimaryKey || c.Hidden != 0 {
+		return false // N.B. we do not know the expression for generated columns
+	}
+	def, _ := c.Default.(string)
+	if c.NotNull && (c.Default == nil || strings.EqualFold(def, "NULL")) {
+		return false
+	}
+	switch strings.ToUpper(def) {
+	case "CURRENT_TIME", "CURRENT_DATE", "CURRENT_TIMESTAMP":
+		return false
+	}
+	return !strings.HasPrefix(def, "(")
+}
+
+// columnDefText returns the definition of the named column as written in the
+// CREATE TABLE statement stmt, including constraints such as REFERENCES and
+// CHECK that are not recorded in a [Column]. It reports false if stmt has no
+// definition for the column.
+func columnDefText(stmt, name string) (string, bool) {
+	var toks []string
+	var pos [][2]int
+	scanTokens(stmt, func(i, j int) {
+		toks = append(toks, stmt[i:j])
+		pos = append(pos, [2]int{i, j})
+	})
+	start := slices.Index(toks, "(")
+	if start < 0 {
+		return "", false
+	}
+	end := matchParen(toks, start)
+	lo := start + 1
+	for i := lo; i <= end; i++ {
+		if toks[i] == "(" && i < end {
+			i = matchParen(toks, i)
+			continue
+		}
+		if toks[i] != "," && i != end {
+			continue
+		}
+		if lo < i && !isTableConstraint(toks[lo]) && unquoteIdent(toks[lo]) == name {
+			return stmt[pos[lo][0]:pos[i-1][1]], true
+		}
+		lo = i + 1
+	}
+	return "", false
+}
+
+// isTableConstraint reports whether tok begins a table constraint rather than
+// a column definition in a CREATE TABLE statement.
+func isTableConstraint(tok string) bool {
+	switch strings.ToUpper(tok) {
+	case "CONSTRAINT", "CHECK", "UNIQUE", "PRIMARY", "FOREIGN":
+		return true
+	}
+	return false
+}
+
+// columnDef renders a column definition for c.
+func columnDef(c Column) string {
+	var sb strings.Builder
+	sb.WriteString(quoteIdent(c.Name))
+	if c.Type != "" {
+		fmt.Fprintf(&sb, " %s", c.Type)
+	}
+	if c.NotNull {
+		sb.WriteString(" NOT NULL")
+	}
+	if c.Default != nil {
+		fmt.Fprintf(&sb, " DEFAULT %v", c.Default)
+	}
+	if c.Collate != "" {
+		fmt.Fprintf(&sb, " COLLATE %s", c.Collate)
+	}
+	return sb.String()
+}
+
+// quoteIdent quotes name as a SQL identifier.
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// uniqueMatch reports the index of the only element of vs satisfying f.
+// It reports false if there is not exactly one such element.
+func uniqueMatch[T any](vs []T, f func(T) bool) (int, bool) {
+	pos := -1
+	for i, v := range vs {
+		if f(v) {
+			if pos >= 0 {
+				return -1, false
+			}
+			pos = i
+		}
+	}
+	return pos, pos >= 0
+}
@@ -0,0 +1,182 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package squibble
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrSchemaAhead is reported when the schema of a database is newer than the
+// current schema. Errors matching it have concrete type [SchemaAheadError].
+var ErrSchemaAhead = errors.New("database schema is ahead of current schema")
+
+// SchemaAheadError is the concrete type of errors reported by [Schema.Apply]
+// when the schema of the database is not in the sequence of updates, but its
+// history shows that it was previously updated to the current schema. This
+// typically means the database was updated by a newer version of the program.
+type SchemaAheadError struct {
+	// Current is the digest of the current schema.
+	Current string
+
+	// Digests are the digests recorded in the history after Current, from
+	// oldest to newest. The last is the digest of the database schema.
+	Digests []string
+
+	// Schema is the schema text recorded in the history for the database
+	// schema, or "" if none was recorded.
+	Schema string
+
+	// Diff describes the differences from the current schema (old) to the
+	// schema of the database (new).
+	Diff *SchemaDiff
+}
+
+func (e SchemaAheadError) Error() string {
+	return fmt.Sprintf("database schema %s is ahead of current schema %s", e.Digests[len(e.Digests)-1], e.Current)
+}
+
+// Is reports whether target is [ErrSchemaAhead].
+func (e SchemaAheadError) Is(target error) bool { return target == ErrSchemaAhead }
+
+// Errors reported by [Schema.Apply] and [Schema.Check] match these values,
+// per [errors.Is]. Each has a concrete type giving further details.
+var (
+	// ErrUnmanagedSchema matches errors of concrete type [UnmanagedSchemaError].
+	ErrUnmanagedSchema = errors.New("unmanaged schema already present")
+
+	// ErrMissingRule matches errors of concrete type [MissingRuleError].
+	ErrMissingRule = errors.New("no update rule found")
+
+	// ErrRuleFailed matches errors of concrete type [RuleFailedError].
+	ErrRuleFailed = errors.New("update rule failed")
+
+	// ErrTargetMismatch matches errors of concrete type [TargetMismatchError].
+	ErrTargetMismatch = errors.New("update rule did not reach its target")
+
+	// ErrInconsistentChain matches errors of concrete type
+	// [InconsistentChainError].
+	ErrInconsistentChain = errors.New("update rules are inconsistent")
+)
+
+// UnmanagedSchemaError is the concrete type of errors reported when the
+// database has a schema, but no schema history, and its schema does not
+// match the current schema. [Schema.ApplyTo] also reports it when the
+// database is empty, since it can only move a managed schema.
+type UnmanagedSchemaError struct {
+	Digest string // the digest of the database schema
+	Empty  bool   // whether the database schema is empty
+}
+
+func (e UnmanagedSchemaError) Error() string {
+	if e.Empty {
+		return fmt.Sprintf("database does not have a managed schema (digest %s)", e.Digest)
+	}
+	return fmt.Sprintf("unmanaged schema already present (digest %s)", e.Digest)
+}
+
+// Is reports whether target is [ErrUnmanagedSchema].
+func (e UnmanagedSchemaError) Is(target error) bool { return target == ErrUnmanagedSchema }
+
+// MissingRuleError is the concrete type of errors reported when no update
+// rule applies to the schema of the database.
+type MissingRuleError struct {
+	Digest string // the digest of the database schema
+}
+
+func (e MissingRuleError) Error() string {
+	return fmt.Sprintf("no update found for digest %s (did you add an update rule?)", e.Digest)
+}
+
+// Is reports whether target is [ErrMissingRule].
+func (e MissingRuleError) Is(target error) bool { return target == ErrMissingRule }
+
+// RuleFailedError is the concrete type of errors reported when the Apply
+// function of an update rule fails, or its Revert function when
+// [Schema.ApplyTo] reverts it.
+type RuleFailedError struct {
+	Rule   int    // the 1-based index of the rule in the Updates of the Schema
+	Source string // the source digest of the rule
+	Target string // the target digest of the rule
+	Revert bool   // whether the Revert function of the rule failed
+	Err    error  // the error reported by the rule
+}
+
+func (e RuleFailedError) Error() string {
+	if e.Revert {
+		return fmt.Sprintf("revert failed at digest %s: %v", e.Target, e.Err)
+	}
+	return fmt.Sprintf("update failed at digest %s: %v", e.Source, e.Err)
+}
+
+// Unwrap returns the error reported by the rule.
+func (e RuleFailedError) Unwrap() error { return e.Err }
+
+// Is reports whether target is [ErrRuleFailed].
+func (e RuleFailedError) Is(target error) bool { return target == ErrRuleFailed }
+
+// TargetMismatchError is the concrete type of errors reported when an update
+// rule succeeds, but the resulting schema does not match its Target. When
+// [Schema.ApplyTo] reverts a rule, it is reported if the schema reached does
+// not match the Source of the rule.
+type TargetMismatchError struct {
+	Rule   int    // the 1-based index of the rule in the Updates of the Schema
+	Source string // the source digest of the rule
+	Target string // the target digest declared by the rule
+	Got    string // the digest of the schema actually reached
+	Revert bool   // whether the rule was reverted, so Source was expected
+
+	// Diff is a human-readable description of the differences between the
+	// schema reached (-lhs) and the expected schema (+rhs), if the text of
+	// the expected schema is known; otherwise "". The text is known for the
+	// current schema, for the TargetSQL of the update rules, and for schemas
+	// recorded in the history.
+	Diff string
+
+	// Changes describes the same differences as Diff, in structured form.
+	// It is nil if Diff is empty.
+	Changes *SchemaDiff
+
+	// Schema is the SQL text of the schema reached, as read from the
+	// database.
+	Schema string
+}
+
+func (e TargetMismatchError) Error() string {
+	msg := fmt.Sprintf("confirming update: got %s, want %s", e.Got, e.Target)
+	if e.Revert {
+		msg = fmt.Sprintf("confirming revert: got %s, want %s", e.Got, e.Source)
+	}
+	if e.Diff != "" {
+		return msg + " (-got, +want):\n" + e.Diff
+	} else if e.Schema != "" {
+		return msg + "; schema reached:\n" + e.Schema
+	}
+	return msg
+}
+
+// Is reports whether target is [ErrTargetMismatch].
+func (e TargetMismatchError) Is(target error) bool { return target == ErrTargetMismatch }
+
+// InconsistentChainError is the concrete type of errors reported by
+// [Schema.Check] when the update rules are not correctly stitched together.
+type InconsistentChainError struct {
+	// Rule is the 1-based index of the rule whose Source does not match the
+	// Target of the preceding rule, or 0 if the last rule does not reach the
+	// current schema.
+	Rule int
+
+	Want string // the expected digest
+	Got  string // the actual digest
+}
+
+func (e InconsistentChainError) Error() string {
+	if e.Rule == 0 {
+		return fmt.Sprintf("missing upgrade from %s to target %s", e.Got, e.Want)
+	}
+	return fmt.Sprintf("upgrade %d: want source %s, got %s", e.Rule, e.Want, e.Got)
+}
+
+// Is reports whether target is [ErrInconsistentChain].
+func (e InconsistentChainError) Is(target error) bool { return target == ErrInconsistentChain }
@@ -0,0 +1,110 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package squibble
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// ForeignKeyError is the concrete type of errors reporting violations of
+// foreign key constraints, as found by PRAGMA foreign_key_check.
+type ForeignKeyError struct {
+	Violations []ForeignKeyViolation
+}
+
+func (f ForeignKeyError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d foreign key violations", len(f.Violations))
+	for i, v := range f.Violations {
+		if i == 5 {
+			fmt.Fprintf(&sb, "; ...")
+			break
+		}
+		sep := ": "
+		if i > 0 {
+			sep = "; "
+		}
+		fmt.Fprintf(&sb, "%s%s", sep, v)
+	}
+	return sb.String()
+}
+
+// A ForeignKeyViolation describes a single row that violates a foreign key
+// constraint.
+type ForeignKeyViolation struct {
+	Table  string // the table containing the row
+	RowID  int64  // the rowid of the row (0 for a WITHOUT ROWID table)
+	Parent string // the table referred to by the constraint
+	FKID   int    // the index of the constraint in PRAGMA foreign_key_list(Table)
+}
+
+func (v ForeignKeyViolation) String() string {
+	return fmt.Sprintf("table %q rowid %d refers to missing row in %q", v.Table, v.RowID, v.Parent)
+}
+
+// checkForeignKeys reports an error of concrete type [ForeignKeyError] if any
+// foreign key constraints of table are violated. If table == "", all tables in
+// the database are checked. If database != "", it names the database
+// containing the table.
+func checkForeignKeys(ctx context.Context, db DBConn, database, table string) error {
+	query := `PRAGMA foreign_key_check`
+	if database != "" {
+		query = fmt.Sprintf(`PRAGMA %s.foreign_key_check`, quoteIdent(database))
+	}
+	if table != "" {
+		query += fmt.Sprintf(`(%s)`, quoteIdent(table))
+	}
+	return foreignKeyCheck(ctx, db, query)
+}
+
+// foreignKeyCheck runs query, which must be a PRAGMA foreign_key_check
+// statement, and reports an error of concrete type [ForeignKeyError] if it
+// reports any violations.
+func foreignKeyCheck(ctx context.Context, db DBConn, query string) error {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("check foreign keys: %w", err)
+	}
+	defer rows.Close()
+	var fe ForeignKeyError
+	for rows.Next() {
+		var v ForeignKeyViolation
+		var rowID sql.NullInt64
+		if err := rows.Scan(&v.Table, &rowID, &v.Parent, &v.FKID); err != nil {
+			return fmt.Errorf("scan foreign key check: %w", err)
+		}
+		v.RowID = rowID.Int64
+		fe.Violations = append(fe.Violations, v)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("check foreign keys: %w", err)
+	} else if len(fe.Violations) != 0 {
+		return fe
+	}
+	return nil
+}
+
+// disableForeignKeys disables foreign key enforcement on conn, if it is
+// enabled, and returns a function that restores the original setting.
+// This must be done outside a transaction, where the setting has no effect.
+func disableForeignKeys(ctx context.Context, conn *sql.Conn) (restore func() error, _ error) {
+	var enabled bool
+	if err := conn.QueryRowContext(ctx, `PRAGMA foreign_keys`).Scan(&enabled); err != nil {
+		return nil, fmt.Errorf("read foreign_keys: %w", err)
+	}
+	if !enabled {
+		return func() error { return nil }, nil
+	}
+	if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF`); err != nil {
+		return nil, fmt.Errorf("disable foreign keys: %w", err)
+	}
+	return func() error {
+		// N.B. Restore even if ctx has ended, since conn returns to the pool.
+		_, err := conn.ExecContext(context.WithoutCancel(ctx), `PRAGMA foreign_keys = ON`)
+		return err
+	}, nil
+}
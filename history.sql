@@ -1,7 +1,10 @@
 -- This table records a history of the schema updates applied to the database
 -- by a squibble.Schema. The contents of this table are not required for the
 -- migrator to work, the records here are for record-keeping and debugging.
-CREATE TABLE IF NOT EXISTS _schema_history (
+--
+-- This file is a format template: The table name is filled in with the quoted
+-- name of the history table, by default "_schema_history".
+CREATE TABLE IF NOT EXISTS %[1]s (
   -- Unix-epoch microseconds at which this schema was applied.
   timestamp INTEGER UNIQUE NOT NULL,
 
@@ -9,5 +12,15 @@ CREATE TABLE IF NOT EXISTS _schema_history (
   digest TEXT NOT NULL,
 
   -- The SQL schema definition text, zstd compressed.
-  schema BLOB
+  schema BLOB,
+
+  -- A description of a step recorded without a schema change, or NULL.
+  note TEXT,
+
+  -- Microseconds elapsed to reach this update, or NULL if unknown.
+  elapsed INTEGER,
+
+  -- Comma-separated 1-based indexes of the update rules applied to reach
+  -- this update, in the order they ran, or NULL if none.
+  rules TEXT
 );
@@ -0,0 +1,156 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package squibble
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// CurrentSchemaFile is the name of the file holding the current schema
+// definition in a directory loaded by [LoadFS].
+const CurrentSchemaFile = "schema.sql"
+
+// LoadFS loads a [Schema] from the SQL files in the specified directory of
+// fsys. This can be used with an [embed.FS] to keep SQL-only migrations as
+// plain SQL files alongside the program.
+//
+// The directory must contain a file named schema.sql (see [CurrentSchemaFile])
+// holding the current schema, and may contain any number of update rule files
+// named NNN-*.sql, where NNN is a decimal sequence number. The rules are
+// ordered by their sequence numbers, which need not be contiguous. Each rule
+// file must begin with a comment header giving the digests of its source and
+// target schemas:
+//
+//	-- Source: <hex-digest>
+//	-- Target: <hex-digest>
+//
+// Digests computed by a digest version other than [DigestV1] include their
+// version tag, for example "v2:<hex-digest>".
+//
+// The Apply function of each rule executes the statements of its file in
+// order, as [Exec] does, so a PRAGMA foreign_key_check statement anywhere in
+// the file reports any violations as an error. Other files in the directory
+// are ignored.
+//
+// The resulting Schema is not checked for consistency, so that the caller may
+// use [Schema.MergeRules] to add rules implemented in Go.
+func LoadFS(fsys fs.FS, dir string) (*Schema, error) {
+	cur, err := fs.ReadFile(fsys, path.Join(dir, CurrentSchemaFile))
+	if err != nil {
+		return nil, fmt.Errorf("read current schema: %w", err)
+	}
+	des, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type ruleFile struct {
+		seq  int
+		name string
+	}
+	var files []ruleFile
+	for _, de := range des {
+		name := de.Name()
+		if de.IsDir() || path.Ext(name) != ".sql" || name == CurrentSchemaFile {
+			continue
+		}
+		num, _, _ := strings.Cut(strings.TrimSuffix(name, ".sql"), "-")
+		seq, err := strconv.Atoi(num)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule file name %q (want NNN-*.sql)", name)
+		}
+		files = append(files, ruleFile{seq: seq, name: name})
+	}
+	slices.SortFunc(files, func(a, b ruleFile) int { return cmp.Compare(a.seq, b.seq) })
+
+	s := &Schema{Current: string(cur)}
+	for i, f := range files {
+		if i > 0 && f.seq == files[i-1].seq {
+			return nil, fmt.Errorf("duplicate rule number %d (%s, %s)", f.seq, files[i-1].name, f.name)
+		}
+		text, err := fs.ReadFile(fsys, path.Join(dir, f.name))
+		if err != nil {
+			return nil, err
+		}
+		rule, err := parseRule(string(text))
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", f.name, err)
+		}
+		s.Updates = append(s.Updates, rule)
+	}
+	return s, nil
+}
+
+// parseRule parses the text of an update rule file.
+func parseRule(text string) (UpdateRule, error) {
+	var rule UpdateRule
+	sc := bufio.NewScanner(strings.NewReader(text))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		com, ok := strings.CutPrefix(line, "--")
+		if !ok {
+			break // end of header
+		}
+		key, val, ok := strings.Cut(com, ":")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "source":
+			rule.Source = strings.TrimSpace(val)
+		case "target":
+			rule.Target = strings.TrimSpace(val)
+		}
+	}
+	if rule.Source == "" || rule.Target == "" {
+		return rule, errors.New("missing Source or Target header")
+	}
+	rule.Apply = Exec(splitStatements(text)...)
+	return rule, nil
+}
+
+// MergeRules merges the specified update rules into the Updates of s.
+//
+// If s already has a rule with the same Source and Target as a merged rule,
+// the existing rule is replaced. This allows a rule file loaded by [LoadFS] to
+// serve as a placeholder for a rule implemented in Go. Otherwise, the rule is
+// inserted at the position where its Source and Target link up with its
+// neighbors. MergeRules reports an error without modifying s if any rule
+// cannot be placed.
+func (s *Schema) MergeRules(rules ...UpdateRule) error {
+	updates := slices.Clone(s.Updates)
+nextRule:
+	for _, r := range rules {
+		for i, u := range updates {
+			if u.Source == r.Source && u.Target == r.Target {
+				updates[i] = r
+				continue nextRule
+			}
+		}
+		for i := 0; i <= len(updates); i++ {
+			if i > 0 && !chained(updates[i-1], r.Source) {
+				continue
+			}
+			if i < len(updates) && !chained(r, updates[i].Source) {
+				continue
+			}
+			updates = slices.Insert(updates, i, r)
+			continue nextRule
+		}
+		return fmt.Errorf("no place for rule from %s to %s", r.Source, r.Target)
+	}
+	s.Updates = updates
+	return nil
+}
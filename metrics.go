@@ -0,0 +1,21 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package squibble
+
+import "time"
+
+// Metrics receives measurements of schema updates from a [Schema], for export
+// to a monitoring system. The methods are called synchronously, and should
+// not block.
+type Metrics interface {
+	// ApplyDone is called when [Schema.Apply] or [Schema.ApplyTo] finishes,
+	// with the plan (nil if planning failed), how long it took, and the error
+	// reported (nil on success).
+	ApplyDone(p *Plan, elapsed time.Duration, err error)
+
+	// RuleDone is called after each update rule is applied or reverted, with
+	// how long it took and the error reported (nil on success). The Tx field
+	// of info must not be used after RuleDone returns.
+	RuleDone(info RuleInfo, elapsed time.Duration, err error)
+}
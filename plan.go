@@ -0,0 +1,153 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package squibble
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+)
+
+// A PlanKind identifies which action [Schema.Apply] takes for a database.
+type PlanKind int
+
+const (
+	// PlanInit means the database has no managed schema and is otherwise
+	// empty, so the current schema will be applied to it directly.
+	PlanInit PlanKind = iota + 1
+
+	// PlanRecord means the database has no schema history, but its schema
+	// already matches the current schema. Only the history will be updated.
+	PlanRecord
+
+	// PlanUpToDate means the database is already at the current schema, and
+	// no changes are needed.
+	PlanUpToDate
+
+	// PlanUpgrade means one or more update rules must be applied to bring the
+	// database up to the current schema.
+	PlanUpgrade
+
+	// PlanAhead means the database schema is newer than the current schema,
+	// but only adds to it (see [Schema.AllowAdditive]). No changes will be
+	// made.
+	PlanAhead
+
+	// PlanRevert means one or more update rules must be reverted to bring the
+	// database back to an earlier schema. It is used only by [Schema.ApplyTo].
+	PlanRevert
+)
+
+func (k PlanKind) String() string {
+	switch k {
+	case PlanInit:
+		return "init"
+	case PlanRecord:
+		return "record"
+	case PlanUpToDate:
+		return "up-to-date"
+	case PlanUpgrade:
+		return "upgrade"
+	case PlanAhead:
+		return "ahead"
+	case PlanRevert:
+		return "revert"
+	default:
+		return fmt.Sprintf("PlanKind(%d)", int(k))
+	}
+}
+
+// A Plan describes the changes [Schema.Apply] would make to a database.
+type Plan struct {
+	Kind   PlanKind // which case applies
+	Source string   // the digest of the database schema before changes
+	Target string   // the digest of the current schema
+
+	// Last is the most recent entry in the schema history of the database,
+	// or nil if the history is empty.
+	Last *HistoryRow
+
+	// Start is the offset in the Updates of the Schema of the first pending
+	// update rule. It is meaningful only when Kind is PlanUpgrade or
+	// PlanRevert.
+	Start int
+
+	// Updates are the update rules that will be applied, in order, or for
+	// PlanRevert, the rules that will be reverted in reverse order.
+	// It is empty unless Kind is PlanUpgrade or PlanRevert.
+	Updates []UpdateRule
+}
+
+// Plan reports what [Schema.Apply] would do to bring db up-to-date, without
+// making any changes. It reports an error if s is not consistent (per
+// [Schema.Check]), or in any other case where Apply would fail before applying
+// any update rules.
+//
+// Plan only reads from db, and does its work inside a transaction that is
+// always rolled back. It does not create or upgrade the schema history table,
+// so it can be used with a read-only database handle.
+func (s *Schema) Plan(ctx context.Context, db *sql.DB) (*Plan, error) {
+	if err := s.Check(); err != nil {
+		return nil, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return s.plan(ctx, tx)
+}
+
+// DryRun computes a plan for db as [Schema.Plan] does, then executes the plan
+// inside a transaction that is always rolled back. DryRun reports an error if
+// any update rule fails, or fails to reach its declared Target. If the plan
+// was computed successfully, it is returned even if executing it fails.
+//
+// The BeforeTx and AfterTx functions of the update rules are not called,
+// since their effects cannot be rolled back, nor are the hooks and metrics
+// of s.
+func (s *Schema) DryRun(ctx context.Context, db *sql.DB) (*Plan, error) {
+	if err := s.Check(); err != nil {
+		return nil, err
+	}
+	s = s.withoutHooks()
+	conn, release, err := s.connect(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	p, err := s.plan(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	return p, s.run(ctx, tx, p)
+}
+
+// withoutHooks returns a copy of s with its hooks removed.
+func (s *Schema) withoutHooks() *Schema {
+	cp := *s
+	cp.BeforeApply, cp.BeforeRule, cp.AfterRule, cp.AfterCommit = nil, nil, nil, nil
+	cp.Metrics = nil
+	return &cp
+}
+
+// rules returns the 1-based indexes of the update rules in p, in the order
+// they are applied or reverted.
+func (p *Plan) rules() []int {
+	out := make([]int, len(p.Updates))
+	for i := range out {
+		out[i] = p.Start + i + 1
+	}
+	if p.Kind == PlanRevert {
+		slices.Reverse(out)
+	}
+	return out
+}
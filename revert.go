@@ -0,0 +1,220 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package squibble
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// ApplyTo updates the schema of db to the version with the given digest,
+// which must be the digest of the current schema or the Source of one of the
+// update rules of s. If digest is later in the sequence of updates than the
+// schema of db, ApplyTo applies the intervening update rules as Apply does. If
+// it is earlier, ApplyTo calls the Revert functions of the intervening rules
+// in reverse order, and checks after each that the schema of db matches the
+// Source of the rule. It is an error if any of those rules lacks a Revert
+// function.
+//
+// If digest is the digest of the current schema, ApplyTo is equivalent to
+// Apply. Otherwise, ApplyTo makes all its changes in a single transaction,
+// and does not call the BeforeTx functions of the update rules. The AfterTx
+// functions of the rules it applies are recorded as pending and called after
+// the transaction commits, as Apply does. In that case db must already have a
+// managed schema.
+//
+// ApplyTo reports errors with the same concrete types as Apply. In addition,
+// it reports an [UnmanagedSchemaError] if db does not have a managed schema,
+// and a [SchemaAheadError] if the schema of db is ahead of the current schema,
+// even if s permits additive changes. The errors for a failed revert are a
+// [RuleFailedError] or [TargetMismatchError] with Revert set.
+//
+// ApplyTo calls the hooks of s as Apply does. The plan passed to AfterCommit
+// has kind [PlanUpgrade] or [PlanRevert], and Target set to digest.
+func (s *Schema) ApplyTo(ctx context.Context, db *sql.DB, digest string) (err error) {
+	if err := s.Check(); err != nil {
+		return err
+	}
+	// Compare digest to the current schema in its own version, since it may be
+	// the Source of a rule written with an older digest version.
+	curHash, err := SQLDigestVersion(s.Current, DigestVersionOf(digest))
+	if err != nil {
+		return err
+	} else if digest == curHash {
+		return s.Apply(ctx, db)
+	}
+	if s.BeforeApply != nil {
+		if err := s.BeforeApply(ctx); err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	var p *Plan
+	defer func() { s.finish(ctx, p, time.Since(start), err) }()
+
+	s.log(ctx, slog.LevelInfo, "checking schema version", "Checking schema version...", slog.String("phase", "plan"))
+	conn, release, err := s.connect(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer release()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	p, err = s.plan(ctx, tx)
+	if err != nil {
+		return err
+	} else if p.Kind == PlanInit {
+		return UnmanagedSchemaError{Digest: p.Source, Empty: true}
+	} else if p.Kind == PlanAhead {
+		hr, err := s.readHistory(ctx, tx)
+		if err != nil {
+			return err
+		}
+		ahead, _, err := s.schemaAhead(ctx, tx, hr, p.Target, p.Source)
+		if err != nil {
+			return err
+		}
+		return ahead
+	}
+
+	// Locate the schema of the database and the target in the sequence of
+	// updates. Prefer a target following the database schema, if there is
+	// one, since moving forward does not require reverts.
+	from := len(s.Updates) // the current schema
+	if p.Kind == PlanUpgrade {
+		from = p.Start
+	}
+	to := s.findVersion(digest, from, curHash)
+	if to < 0 {
+		return MissingRuleError{Digest: digest}
+	} else if to == from {
+		s.log(ctx, slog.LevelInfo, "schema is already at target",
+			fmt.Sprintf("Schema is already at target digest %s", digest), slog.String("digest", digest))
+		p = &Plan{Kind: PlanUpToDate, Source: p.Source, Target: digest, Last: p.Last}
+		return nil
+	}
+
+	if to > from {
+		p = &Plan{Kind: PlanUpgrade, Source: p.Source, Target: digest, Last: p.Last, Start: from, Updates: s.Updates[from:to]}
+		s.log(ctx, slog.LevelInfo, "applying schema updates", fmt.Sprintf("Applying %d schema upgrades to digest %s", to-from, digest),
+			slog.String("phase", "update"), slog.String("source", p.Source), slog.String("target", digest), slog.Int("count", to-from))
+		for j := range p.Updates {
+			if err := s.applyUpdate(ctx, tx, p, j); err != nil {
+				return err
+			}
+		}
+	} else {
+		p = &Plan{Kind: PlanRevert, Source: p.Source, Target: digest, Last: p.Last, Start: to, Updates: s.Updates[to:from]}
+		for i := to; i < from; i++ {
+			if s.Updates[i].Revert == nil {
+				return fmt.Errorf("update %d to %s has no Revert function", i+1, s.Updates[i].Target)
+			}
+		}
+		s.log(ctx, slog.LevelInfo, "reverting schema updates", fmt.Sprintf("Reverting %d schema upgrades to digest %s", from-to, digest),
+			slog.String("phase", "revert"), slog.String("source", p.Source), slog.String("target", digest), slog.Int("count", from-to))
+		for i := from - 1; i >= to; i-- {
+			if err := s.revertUpdate(ctx, tx, i); err != nil {
+				return err
+			}
+		}
+	}
+	if s.DisableForeignKeys {
+		if err := checkForeignKeys(ctx, tx, s.digestOptions().database(), ""); err != nil {
+			return err
+		}
+	}
+
+	// Record the new version, with its schema text if we know it.
+	version := HistoryRow{
+		Timestamp: time.Now(),
+		Digest:    digest,
+		Schema:    s.schemaText(ctx, tx, digest),
+		Elapsed:   time.Since(start),
+		Rules:     p.rules(),
+	}
+	if err := s.addVersion(ctx, tx, version); err != nil {
+		return err
+	}
+	if p.Kind == PlanUpgrade {
+		if err := s.addPendingAfterTx(ctx, tx, digest, p.Start, p.Updates); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("updates failed: %w", err)
+	}
+	s.logUpdated(ctx, p, time.Since(start))
+	if p.Kind == PlanUpgrade {
+		return s.runAfterTx(ctx, conn)
+	}
+	return nil
+}
+
+// findVersion reports the position of digest in the sequence of schema
+// versions defined by s, where position i < len(s.Updates) is the Source of
+// update i, and position len(s.Updates) is the current schema with digest
+// curHash. If digest occurs more than once, the first position at or after
+// from is preferred, and otherwise the last position before it. It returns -1
+// if digest does not occur.
+func (s *Schema) findVersion(digest string, from int, curHash string) int {
+	at := func(i int) string {
+		if i == len(s.Updates) {
+			return curHash
+		}
+		return s.Updates[i].Source
+	}
+	for i := from; i <= len(s.Updates); i++ {
+		if at(i) == digest {
+			return i
+		}
+	}
+	for i := from - 1; i >= 0; i-- {
+		if at(i) == digest {
+			return i
+		}
+	}
+	return -1
+}
+
+// revertUpdate reverts the update rule at offset i of s.Updates, and checks
+// that the result has the expected digest.
+func (s *Schema) revertUpdate(ctx context.Context, tx *sql.Tx, i int) (err error) {
+	start := time.Now()
+	update := s.Updates[i]
+	info := RuleInfo{Index: i + 1, Source: update.Source, Target: update.Target, Revert: true, Tx: tx}
+	if s.Metrics != nil {
+		defer func() { s.Metrics.RuleDone(info, time.Since(start), err) }()
+	}
+	defer func() { s.logRuleFailed(ctx, info, update, err) }()
+	if s.BeforeRule != nil {
+		if err := s.BeforeRule(ctx, info); err != nil {
+			return err
+		}
+	}
+	uctx := context.WithValue(ctx, ctxSchemaKey{}, s)
+	if err := update.Revert(uctx, tx); err != nil {
+		return RuleFailedError{Rule: info.Index, Source: update.Source, Target: update.Target, Revert: true, Err: err}
+	}
+	conf, err := DBDigest(uctx, tx, s.optionsFor(update.Source))
+	if err != nil {
+		return fmt.Errorf("confirming revert: %w", err)
+	}
+	if conf != update.Source {
+		return s.targetMismatch(ctx, tx, info.Index, update, conf, true)
+	}
+	s.log(ctx, slog.LevelInfo, "reverted update", fmt.Sprintf("[%d] reverted to digest %s", info.Index, update.Source),
+		ruleAttrs(i, update, slog.String("phase", "revert"), slog.Duration("elapsed", time.Since(start)))...)
+	if s.AfterRule != nil {
+		return s.AfterRule(ctx, info)
+	}
+	return nil
+}
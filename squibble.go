@@ -18,7 +18,8 @@
 // The Schema tracks schema versions by hashing the schema with SHA256, and it
 // stores a record of upgrades in a _schema_history table that it maintains.
 // Apply creates this table if it does not already exist, and updates it as
-// update rules are applied.
+// update rules are applied. The name of the table can be changed by setting
+// the HistoryTable field of the [Schema].
 //
 // # Update Rules
 //
@@ -43,6 +44,21 @@
 // that point forward. If this succeeds, the current schema is recorded as the
 // latest version in _schema_history.
 //
+// To move a database to a specific version, either forward or backward, use
+// [Schema.ApplyTo]. Moving backward requires each intervening update rule to
+// have a Revert function.
+//
+// To see what Apply would do without changing the database, use
+// [Schema.Plan] to report the pending updates, or [Schema.DryRun] to execute
+// them in a transaction that is always rolled back.
+//
+// # Errors
+//
+// The errors reported by Apply can be distinguished with [errors.Is] using
+// the values [ErrUnmanagedSchema], [ErrMissingRule], [ErrRuleFailed],
+// [ErrTargetMismatch], [ErrInconsistentChain], and [ErrSchemaAhead]. Each has
+// a concrete error type carrying details such as the digests involved.
+//
 // # Validation
 //
 // You use the [Validate] function to check that the current schema in the
@@ -52,39 +68,67 @@
 //
 // # Limitations
 //
-// Currently this package only handles the main database, not attachments.
+// By default, this package manages the main database. To manage an attached
+// database instead, set the Database field of the [Schema], or of the
+// [DigestOptions] passed to functions such as [DBDigest] and [Validate].
 package squibble
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/creachadair/mds/mapset"
 	"github.com/klauspost/compress/zstd"
 
 	_ "embed"
 )
 
 const (
-	// historyTableName is the name of the history log table maintained by the
-	// Schema migrator in a database under its management. See history.sql.
+	// historyTableName is the default name of the history log table maintained
+	// by the Schema migrator in a database under its management. See
+	// history.sql.
 	historyTableName = "_schema_history"
 
-	queryHistoryRows   = `SELECT timestamp, digest, schema FROM ` + historyTableName + ` ORDER BY timestamp`
-	queryHistoryInsert = `INSERT INTO ` + historyTableName + ` (timestamp, digest, schema) VALUES (?, ?, ?)`
+	// These queries are formatted with the quoted name of the history table.
+	queryHistoryRows   = `SELECT timestamp, digest, schema, %[2]s FROM %[1]s ORDER BY timestamp`
+	queryHistoryInsert = `INSERT INTO %[1]s (timestamp, digest, schema, note, elapsed, rules) VALUES (
+  max(?, coalesce((SELECT max(timestamp) + 1 FROM %[1]s), 0)), ?, ?, ?, ?, ?)`
 )
 
+// historyAddedColumns are the columns added to the history table since its
+// original definition, in order. Apply adds any that are missing from an
+// existing history table. See history.sql.
+var historyAddedColumns = []struct{ Name, Type string }{
+	{"note", "TEXT"},
+	{"elapsed", "INTEGER"},
+	{"rules", "TEXT"},
+}
+
+// historyTableSchema is formatted with the quoted name of the history table.
+//
 //go:embed history.sql
 var historyTableSchema string
 
+// historyTableSQL returns the definition of the history table named by opts.
+func historyTableSQL(opts *DigestOptions) string {
+	return fmt.Sprintf(historyTableSchema, opts.historyTableRef())
+}
+
 // Schema defines a family of SQLite schema versions over time, expressed as a
 // SQL definition of the current version of the schema, plus an ordered
 // collection of upgrade rules that define how to update each version to the
@@ -104,11 +148,123 @@ type Schema struct {
 	// except the schema history table.
 	IgnoreTables []string
 
+	// HistoryTable, if non-empty, is the name of the table in which Apply
+	// records the history of schema updates. The default is "_schema_history",
+	// or TablePrefix + "schema_history" if TablePrefix is set.
+	// Separately-versioned schemas sharing a database must use different
+	// history tables, and each must ignore the tables of the others.
+	HistoryTable string
+
+	// TablePrefix, if non-empty, restricts the schema to the tables and views
+	// whose names begin with this prefix, and the indexes and triggers
+	// associated with them. Other objects in the database are ignored, as if
+	// they were listed in IgnoreTables. This allows separately-versioned
+	// schemas to share a database, each owning the tables with its prefix.
+	// Every table and view in Current must have the prefix.
+	TablePrefix string
+
+	// Database, if non-empty, is the name of an attached database to manage,
+	// instead of the main database. The database must be attached on every
+	// connection of the *sql.DB passed to Apply, for example by a connection
+	// hook of the driver, and it also contains the history table. Update rules
+	// must qualify the names of the objects they change with the database
+	// name, except in the arguments of [RebuildTable], which qualifies them
+	// itself. To initialize an empty database, Apply creates each table,
+	// index, view, and trigger of Current in the attached database; other
+	// statements in Current are not executed.
+	Database string
+
+	// DigestVersion, if non-zero, is the digest algorithm used for the
+	// digests of the update rules and the history. The default is DigestV1.
+	// Later versions detect more kinds of schema change; see [DigestVersion].
+	DigestVersion DigestVersion
+
 	// Logf is where logs should be sent; the default is log.Printf.
+	// It is not used if Logger is set.
 	Logf func(string, ...any)
+
+	// Logger, if non-nil, receives structured log records in place of Logf.
+	// Failures of update rules and of Apply are logged at level Error.
+	// Records use these attribute keys:
+	//
+	//   - phase: the step of Apply (plan, update, revert, commit, before-tx,
+	//     or after-tx)
+	//   - rule: the 1-based index of an update rule
+	//   - source, target: the digests before and after a change, as in an
+	//     [UpdateRule] or a [Plan]
+	//   - digest: the digest of a schema that is not changing
+	//   - count: the number of update rules or history records involved
+	//   - unknown: the number of history records that TranslateHistory could
+	//     not translate
+	//   - elapsed: the time taken
+	//   - error: the error reported by a failure
+	Logger *slog.Logger
+
+	// DisableForeignKeys, if true, causes Apply to disable foreign key
+	// enforcement while applying update rules, as recommended for changes
+	// that rebuild tables. Because SQLite ignores this setting inside a
+	// transaction, Apply changes it on a dedicated connection before the
+	// transaction begins, and restores the original setting afterward.
+	// Before committing, Apply checks all foreign key constraints, and fails
+	// with an error of concrete type [ForeignKeyError] if any are violated.
+	DisableForeignKeys bool
+
+	// CommitEachRule, if true, causes Apply to commit each update rule in a
+	// separate transaction, recording the target digest of each in the
+	// history, rather than applying all the pending updates in a single
+	// transaction. If an update fails, the updates before it remain
+	// committed, and a subsequent call to Apply resumes from that point.
+	CommitEachRule bool
+
+	// AllowAdditive, if true, permits Apply to succeed without changes when
+	// the database has a schema newer than the current schema, provided the
+	// newer schema only adds to the current one: New tables, indexes, views,
+	// and triggers, and new columns that are nullable or have a default.
+	// Otherwise, Apply reports an error of concrete type [SchemaAheadError].
+	AllowAdditive bool
+
+	// BeforeApply, if non-nil, is called by Apply before it begins any work
+	// on the database, for example to acquire a lock. If it reports an error,
+	// Apply fails with that error and does not call AfterCommit.
+	BeforeApply func(ctx context.Context) error
+
+	// BeforeRule, if non-nil, is called before each update rule is applied,
+	// inside the transaction that applies it. If it reports an error, the
+	// update fails with that error.
+	BeforeRule func(ctx context.Context, info RuleInfo) error
+
+	// AfterRule, if non-nil, is called after each update rule is applied and
+	// its target digest confirmed, inside the transaction that applied it.
+	// If it reports an error, the update fails with that error.
+	AfterRule func(ctx context.Context, info RuleInfo) error
+
+	// AfterCommit, if non-nil, is called when Apply finishes, after its
+	// transaction has committed or rolled back, with the plan (which is nil
+	// if planning failed) and the error Apply will report (nil on success).
+	AfterCommit func(ctx context.Context, p *Plan, err error)
+
+	// Metrics, if non-nil, receives measurements of each call to Apply and
+	// of each update rule applied.
+	Metrics Metrics
+}
+
+// RuleInfo describes an update rule being applied, as passed to the
+// BeforeRule and AfterRule hooks of a [Schema].
+type RuleInfo struct {
+	Index  int     // the 1-based index of the rule in the Updates of the Schema
+	Source string  // the source digest of the rule
+	Target string  // the target digest of the rule
+	Revert bool    // whether the rule is being reverted (see [Schema.ApplyTo])
+	Tx     *sql.Tx // the transaction in which the rule is applied
 }
 
-// An UpdateRule defines a schema upgrade.
+// An UpdateRule defines a schema upgrade. Only the Source, Target, and Apply
+// fields are required. Since UpdateRule has grown other optional fields,
+// composite literals must name their fields, e.g.
+//
+//	{Source: "...", Target: "...", Apply: squibble.Exec(...)}
+//
+// rather than listing values in order.
 type UpdateRule struct {
 	// Source is the hex-encoded SHA256 digest of the schema at which this
 	// update applies. It must not be empty.
@@ -124,26 +280,81 @@ type UpdateRule struct {
 	// An apply function can use squibble.Logf(ctx, ...) to write log messages
 	// to the logger defined by the associated Schema.
 	Apply func(ctx context.Context, db DBConn) error
+
+	// TargetSQL, if non-empty, is the SQL text of the schema reached by
+	// applying this update. If it is set, its digest must equal Target.
+	// It is used to describe the expected schema when an update fails to
+	// reach its target, and is recorded in the schema history.
+	TargetSQL string
+
+	// BeforeTx, if non-nil, is called before the transaction in which Apply
+	// updates the schema begins, with a connection outside any transaction.
+	// This supports steps that SQLite does not permit in a transaction, such
+	// as VACUUM or changes to the page size.  The BeforeTx functions of all
+	// the pending updates are called in order, before any of them is applied.
+	// BeforeTx must not change the schema.
+	BeforeTx func(ctx context.Context, db DBConn) error
+
+	// AfterTx, if non-nil, is called after the transaction in which Apply
+	// updated the schema has committed, with a connection outside any
+	// transaction. It is otherwise like BeforeTx. The history records that
+	// AfterTx is pending when the update commits, and that it has run when
+	// it succeeds. If AfterTx fails, Apply reports the error but does not
+	// undo the schema update; the next call to Apply runs AfterTx again.
+	AfterTx func(ctx context.Context, db DBConn) error
+
+	// Revert, if non-nil, reverses the changes made by Apply, restoring the
+	// schema from Target back to Source. It is used by [Schema.ApplyTo] to
+	// move a database to an earlier schema version.
+	Revert func(ctx context.Context, db DBConn) error
 }
 
 func (s *Schema) logf(msg string, args ...any) {
-	if s == nil || s.Logf == nil {
+	if s == nil || (s.Logf == nil && s.Logger == nil) {
 		log.Printf(msg, args...)
+	} else if s.Logger != nil {
+		s.Logger.Info(fmt.Sprintf(msg, args...))
 	} else {
 		s.Logf(msg, args...)
 	}
 }
 
+// log records a log message at the given level. If s has a Logger, it
+// receives msg with the given attributes; otherwise text is sent to logf.
+func (s *Schema) log(ctx context.Context, level slog.Level, msg, text string, attrs ...slog.Attr) {
+	if s != nil && s.Logger != nil {
+		s.Logger.LogAttrs(ctx, level, msg, attrs...)
+		return
+	}
+	s.logf("%s", text)
+}
+
+// ruleAttrs returns the log attributes describing update rule i, which has
+// the 1-based index i+1 in the Updates of a [Schema].
+func ruleAttrs(i int, u UpdateRule, attrs ...slog.Attr) []slog.Attr {
+	return append([]slog.Attr{slog.Int("rule", i+1), slog.String("source", u.Source), slog.String("target", u.Target)}, attrs...)
+}
+
 type ctxSchemaKey struct{}
 
 // Logf sends a log message to the logger attached to ctx, or to [log.Printf]
-// if ctx does not have a logger attached. The context passed to the apply
+// if ctx does not have a logger attached. If the logger is a [slog.Logger],
+// the message is logged at level Info. The context passed to the apply
 // function of an UpdateRule will have this set to the logger for the [Schema].
 func Logf(ctx context.Context, msg string, args ...any) {
 	s, _ := ctx.Value(ctxSchemaKey{}).(*Schema)
 	s.logf(msg, args...)
 }
 
+// contextOptions returns the digest options of the [Schema] attached to ctx,
+// or nil if there is none.
+func contextOptions(ctx context.Context) *DigestOptions {
+	if s, _ := ctx.Value(ctxSchemaKey{}).(*Schema); s != nil {
+		return s.digestOptions()
+	}
+	return nil
+}
+
 // Apply applies any pending schema migrations to the given database.  It
 // reports an error immediately if s is not consistent (per [Schema.Check]);
 // otherwise it creates a new transaction and attempts to apply all applicable
@@ -154,129 +365,667 @@ func Logf(ctx context.Context, msg string, args ...any) {
 // When applying a schema to an existing unmanaged database, Apply reports an
 // error if the current schema is not compatible with the existing schema;
 // otherwise it applies the current schema and updates the history.
-func (s *Schema) Apply(ctx context.Context, db *sql.DB) error {
+func (s *Schema) Apply(ctx context.Context, db *sql.DB) (err error) {
 	if err := s.Check(); err != nil {
 		return err
 	}
+	if s.BeforeApply != nil {
+		if err := s.BeforeApply(ctx); err != nil {
+			return err
+		}
+	}
 
-	s.logf("Checking schema version...")
-	tx, err := db.BeginTx(ctx, nil)
+	start := time.Now()
+	var p *Plan
+	defer func() { s.finish(ctx, p, time.Since(start), err) }()
+
+	s.log(ctx, slog.LevelInfo, "checking schema version", "Checking schema version...", slog.String("phase", "plan"))
+	conn, release, err := s.connect(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := s.runBeforeTx(ctx, conn); err != nil {
+		return err
+	}
+	tx, err := conn.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	// Stage 1: Create the schema versions table, if it does not exist.
-	// TODO(creachadair): Plumb an option for the table name.
-	if _, err := tx.ExecContext(ctx, historyTableSchema); err != nil {
-		return fmt.Errorf("create schema history: %w", err)
+	p, err = s.plan(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if s.CommitEachRule && p.Kind == PlanUpgrade {
+		if err := s.runEach(ctx, conn, tx, p); err != nil {
+			return err
+		}
+		s.logUpdated(ctx, p, time.Since(start))
+		return s.runAfterTx(ctx, conn)
+	}
+	if err := s.run(ctx, tx, p); err != nil {
+		return err
+	}
+	switch p.Kind {
+	case PlanUpToDate, PlanAhead:
+		tx.Rollback() // nothing to commit; AfterTx must not run in tx
+		return s.runAfterTx(ctx, conn)
+	case PlanUpgrade:
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("upgrades failed: %w", err)
+		}
+		s.logUpdated(ctx, p, time.Since(start))
+		return s.runAfterTx(ctx, conn)
+	default:
+		return tx.Commit()
+	}
+}
+
+// finish reports the completion of an update with plan p, which may be nil,
+// to the hooks and metrics of s.
+func (s *Schema) finish(ctx context.Context, p *Plan, elapsed time.Duration, err error) {
+	if err != nil {
+		s.log(ctx, slog.LevelError, "schema update failed", fmt.Sprintf("Schema update failed: %v", err),
+			slog.Duration("elapsed", elapsed), slog.Any("error", err))
+	}
+	if s.Metrics != nil {
+		s.Metrics.ApplyDone(p, elapsed, err)
+	}
+	if s.AfterCommit != nil {
+		s.AfterCommit(ctx, p, err)
+	}
+}
+
+// connect returns a dedicated connection to db. If s requests it, foreign key
+// enforcement is disabled on the connection. The caller must call release
+// when finished with the connection, to restore its settings and return it to
+// the pool.
+func (s *Schema) connect(ctx context.Context, db *sql.DB) (_ *sql.Conn, release func(), _ error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, nil, err
 	}
+	restore := func() error { return nil }
+	if s.DisableForeignKeys {
+		restore, err = disableForeignKeys(ctx, conn)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	return conn, func() {
+		if err := restore(); err != nil {
+			// Do not return a connection with the wrong settings to the pool.
+			s.log(ctx, slog.LevelWarn, "restoring connection settings failed",
+				fmt.Sprintf("Restoring connection settings failed: %v", err), slog.Any("error", err))
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+	}, nil
+}
 
-	// Stage 2: Check whether the schema is up-to-date.
-	digestOpts := &DigestOptions{IgnoreTables: s.IgnoreTables}
-	curHash, err := SQLDigest(s.Current)
+// runBeforeTx calls the BeforeTx functions of the pending update rules, if
+// there are any, recording each in the history.
+func (s *Schema) runBeforeTx(ctx context.Context, conn *sql.Conn) error {
+	if !slices.ContainsFunc(s.Updates, func(u UpdateRule) bool { return u.BeforeTx != nil }) {
+		return nil
+	}
+
+	// Find out which updates are pending, without applying any of them.
+	tx, err := conn.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	latestHash, err := DBDigest(ctx, tx, digestOpts)
+	p, err := s.plan(ctx, tx)
+	tx.Rollback()
+	if err != nil || p.Kind != PlanUpgrade {
+		return err // if this failed, the main transaction will report it
+	}
+
+	uctx := context.WithValue(ctx, ctxSchemaKey{}, s)
+	for j, update := range p.Updates {
+		if update.BeforeTx == nil {
+			continue
+		}
+		start := time.Now()
+		if err := update.BeforeTx(uctx, conn); err != nil {
+			return fmt.Errorf("before update at digest %s: %w", update.Source, err)
+		}
+		if err := s.addVersion(ctx, conn, HistoryRow{
+			Timestamp: time.Now(),
+			Digest:    p.Source,
+			Note:      fmt.Sprintf("before update %d to %s", p.Start+j+1, update.Target),
+			Elapsed:   time.Since(start),
+			Rules:     []int{p.Start + j + 1},
+		}); err != nil {
+			return err
+		}
+		s.log(ctx, slog.LevelInfo, "ran pre-transaction step",
+			fmt.Sprintf("[%d] ran pre-transaction step at digest %s", p.Start+j+1, p.Source),
+			ruleAttrs(p.Start+j, update, slog.String("phase", "before-tx"), slog.Duration("elapsed", time.Since(start)))...)
+	}
+	return nil
+}
+
+// Notes recorded in the history for the AfterTx function of an update rule.
+// The first is recorded when the update commits, the second when AfterTx
+// succeeds.
+const (
+	notePendingAfterTx = "pending after update %d to %s"
+	noteAfterTx        = "after update %d to %s"
+)
+
+// addPendingAfterTx records in the history that the AfterTx functions of the
+// given updates, starting at offset start of the Updates of s, are pending.
+// The database is at the schema with the given digest.
+func (s *Schema) addPendingAfterTx(ctx context.Context, db DBConn, digest string, start int, updates []UpdateRule) error {
+	for j, update := range updates {
+		if update.AfterTx == nil {
+			continue
+		}
+		if err := s.addVersion(ctx, db, HistoryRow{
+			Timestamp: time.Now(),
+			Digest:    digest,
+			Note:      fmt.Sprintf(notePendingAfterTx, start+j+1, update.Target),
+			Rules:     []int{start + j + 1},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runAfterTx calls the AfterTx functions that the history of the database
+// records as pending, in the order their updates committed, recording each
+// in the history when it succeeds.
+func (s *Schema) runAfterTx(ctx context.Context, conn *sql.Conn) error {
+	if !slices.ContainsFunc(s.Updates, func(u UpdateRule) bool { return u.AfterTx != nil }) {
+		return nil
+	}
+	hr, err := s.readHistory(ctx, conn)
+	if err != nil || len(hr) == 0 {
+		return err
+	}
+	type step struct {
+		rule   int
+		target string
+	}
+	var pending []step
+	for _, h := range hr {
+		var st step
+		if _, err := fmt.Sscanf(h.Note, notePendingAfterTx, &st.rule, &st.target); err == nil {
+			pending = append(pending, st)
+		} else if _, err := fmt.Sscanf(h.Note, noteAfterTx, &st.rule, &st.target); err == nil {
+			pending = slices.DeleteFunc(pending, func(p step) bool { return p == st })
+		}
+	}
+	digest := hr[len(hr)-1].Digest
+	uctx := context.WithValue(ctx, ctxSchemaKey{}, s)
+	for _, st := range pending {
+		if st.rule < 1 || st.rule > len(s.Updates) || s.Updates[st.rule-1].Target != st.target ||
+			s.Updates[st.rule-1].AfterTx == nil {
+			s.log(ctx, slog.LevelWarn, "pending post-transaction step has no matching rule",
+				fmt.Sprintf("[%d] pending post-transaction step to %s has no matching rule", st.rule, st.target),
+				slog.String("phase", "after-tx"), slog.Int("rule", st.rule), slog.String("target", st.target))
+			continue
+		}
+		start := time.Now()
+		if err := s.Updates[st.rule-1].AfterTx(uctx, conn); err != nil {
+			return fmt.Errorf("after update to digest %s: %w", st.target, err)
+		}
+		if err := s.addVersion(ctx, conn, HistoryRow{
+			Timestamp: time.Now(),
+			Digest:    digest,
+			Note:      fmt.Sprintf(noteAfterTx, st.rule, st.target),
+			Elapsed:   time.Since(start),
+			Rules:     []int{st.rule},
+		}); err != nil {
+			return err
+		}
+		s.log(ctx, slog.LevelInfo, "ran post-transaction step",
+			fmt.Sprintf("[%d] ran post-transaction step at digest %s", st.rule, digest),
+			ruleAttrs(st.rule-1, s.Updates[st.rule-1], slog.String("phase", "after-tx"), slog.Duration("elapsed", time.Since(start)))...)
+	}
+	return nil
+}
+
+// initSchema initializes the empty database managed by tx with the current
+// schema of s.
+func (s *Schema) initSchema(ctx context.Context, tx *sql.Tx) error {
+	if s.Database == "" || s.Database == "main" {
+		_, err := tx.ExecContext(ctx, s.Current)
+		return err
+	}
+	stmts, err := qualifiedSchema(ctx, s.Current, s.Database)
 	if err != nil {
 		return err
 	}
+	return Exec(stmts...)(ctx, tx)
+}
+
+// plan computes a plan for bringing the database managed by tx up-to-date
+// with s, without applying any of the updates it selects. It only reads from
+// the database; the history table is created when it is first written.
+func (s *Schema) plan(ctx context.Context, tx *sql.Tx) (*Plan, error) {
+	// Stage 1: Check whether the schema is up-to-date.
+	curHash, err := s.sqlDigest(s.Current)
+	if err != nil {
+		return nil, err
+	}
+	latestHash, err := DBDigest(ctx, tx, s.digestOptions())
+	if err != nil {
+		return nil, err
+	}
+	p := &Plan{Source: latestHash, Target: curHash}
 
-	hr, err := History(ctx, tx)
+	hr, err := s.readHistory(ctx, tx)
 	if err != nil {
-		return fmt.Errorf("reading update history: %w", err)
+		return nil, fmt.Errorf("reading update history: %w", err)
 	} else if len(hr) == 0 {
 		// Case 1: There is no schema present in the history table.
 		if latestHash != curHash {
-			if !schemaIsEmpty(ctx, tx, "main") {
-				return errors.New("unmanaged schema already present")
+			if !schemaIsEmpty(ctx, tx, s.digestOptions()) {
+				return nil, UnmanagedSchemaError{Digest: latestHash}
 			}
-			if _, err := tx.ExecContext(ctx, s.Current); err != nil {
-				return fmt.Errorf("apply schema: %w", err)
-			}
-			s.logf("Initialized database with schema %s", curHash)
+			p.Kind = PlanInit
 		} else {
-			s.logf("Schema %s is already current; updating history", curHash)
-		}
-		if err := s.addVersion(ctx, tx, HistoryRow{
-			Timestamp: time.Now(),
-			Digest:    curHash,
-			Schema:    s.Current,
-		}); err != nil {
-			return err
+			p.Kind = PlanRecord
 		}
-		return tx.Commit()
+		return p, nil
 	}
+	p.Last = &hr[len(hr)-1]
 
 	// Case 2: The current schema is up-to-date.
 	if latestHash == curHash {
-		s.logf("Schema is up-to-date at digest %s", curHash)
-		return nil
+		p.Kind = PlanUpToDate
+		return p, nil
 	}
 
-	// Case 3: The current schema is not the latest.  Apply pending changes.
-	last := hr[len(hr)-1]
-	s.logf("Last updated to %s at %s", last.Digest, last.Timestamp.Format(time.RFC3339Nano))
-	s.logf("Database schema: %s", latestHash)
-	s.logf("Target schema:   %s", curHash)
-
+	// Case 3: The current schema is not the latest.  Find the pending changes.
+	//
 	// N.B. It is possible that a given schema will repeat in the history.  In
 	// that case, however, it doesn't matter which one we start from: All the
 	// upgrades following ANY copy of that schema apply to all of them.  We
 	// choose the last, just because it's less work if that happens.
-	i := s.firstPendingUpdate(latestHash)
-	if i < 0 {
-		return fmt.Errorf("no update found for digest %s (did you add an update rule?)", latestHash)
+	i, err := s.firstPendingUpdate(ctx, tx, latestHash)
+	if err != nil {
+		return nil, err
+	} else if i < 0 {
+		// Case 4: The database schema is newer than the current one.
+		if ok, err := s.checkAhead(ctx, tx, hr, curHash, latestHash); err != nil {
+			return nil, err
+		} else if ok {
+			p.Kind = PlanAhead
+			return p, nil
+		}
+		return nil, MissingRuleError{Digest: latestHash}
 	}
+	p.Kind = PlanUpgrade
+	p.Start = i
+	p.Updates = s.Updates[i:]
+	return p, nil
+}
 
-	// Apply all the updates from the latest hash to the present.
-	s.logf("Applying %d pending schema upgrades", len(s.Updates)-i)
-	uctx := context.WithValue(ctx, ctxSchemaKey{}, s)
-	for j, update := range s.Updates[i:] {
-		if err := update.Apply(uctx, tx); err != nil {
-			return fmt.Errorf("update failed at digest %s: %w", update.Source, err)
+// checkAhead checks whether the history hr shows that the database managed by
+// tx was updated to the current schema (curHash) before reaching its present
+// schema (latestHash). If not, it reports false without error. Otherwise, it
+// reports true if s permits the changes, or an error of concrete type
+// [SchemaAheadError] if not.
+func (s *Schema) checkAhead(ctx context.Context, tx *sql.Tx, hr []HistoryRow, curHash, latestHash string) (bool, error) {
+	ahead, ok, err := s.schemaAhead(ctx, tx, hr, curHash, latestHash)
+	if err != nil || !ok {
+		return false, err
+	}
+	if s.AllowAdditive && ahead.Diff.isAdditive() {
+		return true, nil
+	}
+	return false, ahead
+}
+
+// schemaAhead constructs a [SchemaAheadError] describing how the schema of
+// the database managed by tx (latestHash) differs from the current schema
+// (curHash). It reports false if the history hr does not show that the
+// database was updated to the current schema.
+func (s *Schema) schemaAhead(ctx context.Context, tx *sql.Tx, hr []HistoryRow, curHash, latestHash string) (SchemaAheadError, bool, error) {
+	k := len(hr) - 1
+	for k >= 0 && hr[k].Digest != curHash {
+		k--
+	}
+	if k < 0 {
+		return SchemaAheadError{}, false, nil // never reached the current schema
+	}
+
+	ahead := SchemaAheadError{Current: curHash}
+	for _, h := range hr[k+1:] {
+		if h.Digest != curHash && !slices.Contains(ahead.Digests, h.Digest) {
+			ahead.Digests = append(ahead.Digests, h.Digest)
 		}
-		conf, err := DBDigest(uctx, tx, digestOpts)
-		if err != nil {
-			return fmt.Errorf("confirming update: %w", err)
+		if h.Digest == latestHash && h.Schema != "" {
+			ahead.Schema = h.Schema
+		}
+	}
+	if !slices.Contains(ahead.Digests, latestHash) {
+		ahead.Digests = append(ahead.Digests, latestHash)
+	}
+
+	cur, err := schemaTextToRows(ctx, s.Current, s.DigestVersion)
+	if err != nil {
+		return SchemaAheadError{}, false, err
+	}
+	main, err := readSchema(ctx, tx, s.digestOptions())
+	if err != nil {
+		return SchemaAheadError{}, false, err
+	}
+	ahead.Diff = newSchemaDiff(cur, main)
+	return ahead, true, nil
+}
+
+// run executes the plan p against the database managed by tx. The caller is
+// responsible for committing or rolling back tx.
+func (s *Schema) run(ctx context.Context, tx *sql.Tx, p *Plan) error {
+	start := time.Now()
+	switch p.Kind {
+	case PlanInit:
+		if err := s.initSchema(ctx, tx); err != nil {
+			return fmt.Errorf("apply schema: %w", err)
+		}
+		s.log(ctx, slog.LevelInfo, "initialized database",
+			fmt.Sprintf("Initialized database with schema %s", p.Target), slog.String("digest", p.Target))
+
+	case PlanRecord:
+		s.log(ctx, slog.LevelInfo, "schema is already current; updating history",
+			fmt.Sprintf("Schema %s is already current; updating history", p.Target), slog.String("digest", p.Target))
+
+	case PlanUpToDate:
+		s.log(ctx, slog.LevelInfo, "schema is up-to-date",
+			fmt.Sprintf("Schema is up-to-date at digest %s", p.Target), slog.String("digest", p.Target))
+		return nil
+
+	case PlanAhead:
+		s.log(ctx, slog.LevelWarn, "schema is ahead of current schema, but compatible",
+			fmt.Sprintf("Database schema %s is ahead of current schema %s, but compatible", p.Source, p.Target),
+			slog.String("source", p.Source), slog.String("target", p.Target))
+		return nil
+
+	case PlanUpgrade:
+		s.logUpgrade(ctx, p)
+
+		// Apply all the updates from the latest hash to the present.
+		for j := range p.Updates {
+			if err := s.applyUpdate(ctx, tx, p, j); err != nil {
+				return err
+			}
 		}
-		if conf != update.Target {
-			return fmt.Errorf("confirming update: got %s, want %s", conf, update.Target)
+		if s.DisableForeignKeys {
+			if err := checkForeignKeys(ctx, tx, s.digestOptions().database(), ""); err != nil {
+				return err
+			}
 		}
-		s.logf("[%d] updated to digest %s", i+j+1, update.Target)
+
+	default:
+		return fmt.Errorf("unknown plan kind %v", p.Kind)
 	}
+
 	// Now record that we made it to the front of the history.
 	if err := s.addVersion(ctx, tx, HistoryRow{
 		Timestamp: time.Now(),
-		Digest:    curHash,
+		Digest:    p.Target,
 		Schema:    s.Current,
+		Elapsed:   time.Since(start),
+		Rules:     p.rules(),
 	}); err != nil {
 		return err
 	}
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("upgrades failed: %w", err)
+	if p.Kind == PlanUpgrade {
+		return s.addPendingAfterTx(ctx, tx, p.Target, p.Start, p.Updates)
 	}
-	s.logf("Schema successfully updated to digest %s", curHash)
 	return nil
 }
 
-func (s *Schema) addVersion(ctx context.Context, tx *sql.Tx, version HistoryRow) error {
-	_, err := tx.ExecContext(ctx, queryHistoryInsert,
-		version.Timestamp.UnixMicro(), version.Digest, compress(version.Schema))
+// targetMismatch constructs a [TargetMismatchError] for update rule i, which
+// reached the schema with digest got rather than its declared target, or
+// rather than its source if revert is true.
+func (s *Schema) targetMismatch(ctx context.Context, tx *sql.Tx, i int, update UpdateRule, got string, revert bool) error {
+	tm := TargetMismatchError{Rule: i, Source: update.Source, Target: update.Target, Got: got, Revert: revert}
+	want := update.Target
+	if revert {
+		want = update.Source
+	}
+	opts := s.optionsFor(want)
+	main, err := readSchema(ctx, tx, opts)
+	if err != nil {
+		return tm // the best we can do
+	}
+	tm.Schema = dumpSchema(main)
+	if text := s.schemaText(ctx, tx, want); text != "" {
+		if want, err := schemaTextToRows(ctx, text, opts.Version); err == nil {
+			diff := newSchemaDiff(main, want)
+			tm.Diff, tm.Changes = diff.String(), diff
+		}
+	}
+	return tm
+}
+
+// schemaText returns the SQL text of the schema with the given digest, if it
+// is known, or else "". The text is known for the current schema, for the
+// TargetSQL of any update rule, and for any schema with text recorded in the
+// history of the database managed by tx.
+func (s *Schema) schemaText(ctx context.Context, tx *sql.Tx, digest string) string {
+	if hc, err := SQLDigestVersion(s.Current, DigestVersionOf(digest)); err == nil && hc == digest {
+		return s.Current
+	}
+	for _, u := range s.Updates {
+		if u.Target == digest && u.TargetSQL != "" {
+			return u.TargetSQL
+		}
+	}
+	hr, err := ReadHistory(ctx, tx, s.digestOptions())
+	if err != nil {
+		return ""
+	}
+	for i := len(hr) - 1; i >= 0; i-- {
+		if hr[i].Digest == digest && hr[i].Schema != "" {
+			return hr[i].Schema
+		}
+	}
+	return ""
+}
+
+func (s *Schema) logUpgrade(ctx context.Context, p *Plan) {
+	if s.Logger != nil {
+		s.Logger.LogAttrs(ctx, slog.LevelInfo, "applying pending schema updates", slog.String("phase", "update"),
+			slog.String("source", p.Source), slog.String("target", p.Target), slog.Int("count", len(p.Updates)))
+		return
+	}
+	s.logf("Last updated to %s at %s", p.Last.Digest, p.Last.Timestamp.Format(time.RFC3339Nano))
+	s.logf("Database schema: %s", p.Source)
+	s.logf("Target schema:   %s", p.Target)
+	s.logf("Applying %d pending schema upgrades", len(p.Updates))
+}
+
+// logUpdated logs the successful update of a database by plan p.
+func (s *Schema) logUpdated(ctx context.Context, p *Plan, elapsed time.Duration) {
+	s.log(ctx, slog.LevelInfo, "schema updated", fmt.Sprintf("Schema successfully updated to digest %s", p.Target),
+		slog.String("source", p.Source), slog.String("target", p.Target), slog.Duration("elapsed", elapsed))
+}
+
+// applyUpdate applies the update rule at offset j of the plan p to tx, and
+// checks that the result has the expected digest.
+func (s *Schema) applyUpdate(ctx context.Context, tx *sql.Tx, p *Plan, j int) (err error) {
+	start := time.Now()
+	update := p.Updates[j]
+	info := RuleInfo{Index: p.Start + j + 1, Source: update.Source, Target: update.Target, Tx: tx}
+	if s.Metrics != nil {
+		defer func() { s.Metrics.RuleDone(info, time.Since(start), err) }()
+	}
+	defer func() { s.logRuleFailed(ctx, info, update, err) }()
+	if s.BeforeRule != nil {
+		if err := s.BeforeRule(ctx, info); err != nil {
+			return err
+		}
+	}
+	uctx := context.WithValue(ctx, ctxSchemaKey{}, s)
+	if err := update.Apply(uctx, tx); err != nil {
+		return RuleFailedError{Rule: info.Index, Source: update.Source, Target: update.Target, Err: err}
+	}
+	conf, err := DBDigest(uctx, tx, s.optionsFor(update.Target))
+	if err != nil {
+		return fmt.Errorf("confirming update: %w", err)
+	}
+	if conf != update.Target {
+		return s.targetMismatch(ctx, tx, info.Index, update, conf, false)
+	}
+	s.log(ctx, slog.LevelInfo, "applied update", fmt.Sprintf("[%d] updated to digest %s", info.Index, update.Target),
+		ruleAttrs(info.Index-1, update, slog.String("phase", "update"), slog.Duration("elapsed", time.Since(start)))...)
+	if s.AfterRule != nil {
+		return s.AfterRule(ctx, info)
+	}
+	return nil
+}
+
+// logRuleFailed logs the failure of the update rule described by info, if
+// err is not nil.
+func (s *Schema) logRuleFailed(ctx context.Context, info RuleInfo, update UpdateRule, err error) {
+	if err == nil {
+		return
+	}
+	phase, verb := "update", "update"
+	if info.Revert {
+		phase, verb = "revert", "revert"
+	}
+	s.log(ctx, slog.LevelError, verb+" rule failed", fmt.Sprintf("[%d] %s failed: %v", info.Index, verb, err),
+		ruleAttrs(info.Index-1, update, slog.String("phase", phase), slog.Any("error", err))...)
+}
+
+// runEach applies the updates in p as run does, but commits each update in a
+// separate transaction, recording its target in the history. The first update
+// is applied in tx, the transaction in which p was planned.
+func (s *Schema) runEach(ctx context.Context, conn *sql.Conn, tx *sql.Tx, p *Plan) error {
+	s.logUpgrade(ctx, p)
+	for j, update := range p.Updates {
+		if j > 0 {
+			var err error
+			tx, err = conn.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+		}
+		err := func() error {
+			defer tx.Rollback()
+			start := time.Now()
+			if err := s.applyUpdate(ctx, tx, p, j); err != nil {
+				return err
+			}
+			if s.DisableForeignKeys {
+				if err := checkForeignKeys(ctx, tx, s.digestOptions().database(), ""); err != nil {
+					return err
+				}
+			}
+			version := HistoryRow{
+				Timestamp: time.Now(),
+				Digest:    update.Target,
+				Schema:    update.TargetSQL,
+				Elapsed:   time.Since(start),
+				Rules:     []int{p.Start + j + 1},
+			}
+			if j == len(p.Updates)-1 {
+				// The last rule may declare its target with a different digest
+				// version than the schema uses.
+				version.Digest, version.Schema = p.Target, s.Current
+			}
+			if err := s.addVersion(ctx, tx, version); err != nil {
+				return err
+			}
+			if err := s.addPendingAfterTx(ctx, tx, version.Digest, p.Start+j, p.Updates[j:j+1]); err != nil {
+				return err
+			}
+			if err := tx.Commit(); err != nil {
+				return fmt.Errorf("update %d failed: %w", p.Start+j+1, err)
+			}
+			s.log(ctx, slog.LevelInfo, "committed update", fmt.Sprintf("[%d] committed update to digest %s", p.Start+j+1, version.Digest),
+				ruleAttrs(p.Start+j, update, slog.String("phase", "commit"))...)
+			return nil
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// optionsFor returns the digest options of s, with the version of digest.
+func (s *Schema) optionsFor(digest string) *DigestOptions {
+	opts := s.digestOptions()
+	opts.Version = DigestVersionOf(digest)
+	return opts
+}
+
+func (s *Schema) digestOptions() *DigestOptions {
+	return &DigestOptions{
+		IgnoreTables: s.IgnoreTables,
+		HistoryTable: s.HistoryTable,
+		TablePrefix:  s.TablePrefix,
+		Database:     s.Database,
+		Version:      s.DigestVersion,
+	}
+}
+
+// addVersion adds a record to the schema history, creating or upgrading the
+// history table first if necessary.  To keep the timestamps unique, the
+// timestamp of the record is adjusted forward if it does not follow all the
+// existing records.
+func (s *Schema) addVersion(ctx context.Context, db DBConn, version HistoryRow) error {
+	if err := upgradeHistory(ctx, db, s.digestOptions()); err != nil {
+		return fmt.Errorf("upgrade schema history: %w", err)
+	}
+	var schema []byte
+	if version.Schema != "" {
+		schema = compress(version.Schema)
+	}
+	var note, rules sql.NullString
+	if version.Note != "" {
+		note = sql.NullString{String: version.Note, Valid: true}
+	}
+	if len(version.Rules) != 0 {
+		rs := make([]string, len(version.Rules))
+		for i, r := range version.Rules {
+			rs[i] = strconv.Itoa(r)
+		}
+		rules = sql.NullString{String: strings.Join(rs, ","), Valid: true}
+	}
+	_, err := db.ExecContext(ctx, fmt.Sprintf(queryHistoryInsert, s.digestOptions().historyTableRef()),
+		version.Timestamp.UnixMicro(), version.Digest, schema, note, version.Elapsed.Microseconds(), rules)
 	if err != nil {
 		return fmt.Errorf("record schema %s: %w", version.Digest, err)
 	}
 	return nil
 }
 
-func (s *Schema) firstPendingUpdate(digest string) int {
+// firstPendingUpdate returns the offset of the last update rule whose Source
+// is the digest of the schema of db, or -1 if there is none. The digest of db
+// in the version of s is latest. For rules whose Source has another digest
+// version, the digest of db is computed in that version.
+func (s *Schema) firstPendingUpdate(ctx context.Context, db DBConn, latest string) (int, error) {
+	digests := map[DigestVersion]string{s.digestOptions().version(): latest}
 	for i := len(s.Updates) - 1; i >= 0; i-- {
-		if s.Updates[i].Source == digest {
-			return i
+		src := s.Updates[i].Source
+		d, ok := digests[DigestVersionOf(src)]
+		if !ok {
+			var err error
+			d, err = DBDigest(ctx, db, s.optionsFor(src))
+			if err != nil {
+				return -1, err
+			}
+			digests[DigestVersionOf(src)] = d
+		}
+		if src == d {
+			return i, nil
 		}
 	}
-	return -1
+	return -1, nil
 }
 
 // Check reports an error if there are consistency problems with the schema
@@ -285,42 +1034,118 @@ func (s *Schema) firstPendingUpdate(digest string) int {
 // A Schema is consistent if it has a non-empty Current schema text, all the
 // update rules are correctly stitched (prev.Target == next.Source), and the
 // last update rule in the sequence has the current schema as its target.
+//
+// The update rules may use digests of different versions, as when the
+// DigestVersion of a Schema is changed after some rules were written. Where
+// the Target of one rule and the Source of the next have different versions,
+// the first rule must have a TargetSQL, and Check compares the digest of that
+// text in the version of the next Source.
 func (s *Schema) Check() error {
 	if s.Current == "" {
 		return errors.New("no current schema is defined")
 	}
-	hc, err := SQLDigest(s.Current)
+	if v := s.DigestVersion; v != 0 && !v.valid() {
+		return fmt.Errorf("unknown digest version %d", v)
+	}
+	hc, err := s.sqlDigest(s.Current)
 	if err != nil {
 		return err
 	}
 	var errs []error
-	var last string
+	if s.TablePrefix != "" {
+		sr, err := schemaTextToRows(context.Background(), s.Current, s.DigestVersion)
+		if err != nil {
+			return err
+		}
+		for _, r := range sr {
+			if !strings.HasPrefix(r.TableName, s.TablePrefix) {
+				errs = append(errs, fmt.Errorf("current schema: %s %q does not have prefix %q", r.Type, r.Name, s.TablePrefix))
+			}
+		}
+	}
 	for i, u := range s.Updates {
 		if u.Source == "" {
 			errs = append(errs, fmt.Errorf("upgrade %d: missing source", i+1))
+		} else if !DigestVersionOf(u.Source).valid() {
+			errs = append(errs, fmt.Errorf("upgrade %d: unknown digest version in source %q", i+1, u.Source))
 		}
 		if u.Target == "" {
 			errs = append(errs, fmt.Errorf("upgrade %d: missing target", i+1))
+		} else if !DigestVersionOf(u.Target).valid() {
+			errs = append(errs, fmt.Errorf("upgrade %d: unknown digest version in target %q", i+1, u.Target))
 		}
 		if u.Apply == nil {
 			errs = append(errs, fmt.Errorf("upgrade %d: missing Apply function", i+1))
 		}
+		if u.TargetSQL != "" {
+			if d, err := SQLDigestVersion(u.TargetSQL, DigestVersionOf(u.Target)); err != nil {
+				errs = append(errs, fmt.Errorf("upgrade %d: target SQL: %w", i+1, err))
+			} else if d != u.Target {
+				errs = append(errs, fmt.Errorf("upgrade %d: target SQL has digest %s, want %s", i+1, d, u.Target))
+			}
+		}
 
-		if last != "" && u.Source != last {
-			errs = append(errs, fmt.Errorf("upgrade %d: want source %s, got %s", i+1, last, u.Source))
+		if i == 0 {
+			continue
+		}
+		if prev := s.Updates[i-1]; prev.Target != "" && !chained(prev, u.Source) {
+			var err error = InconsistentChainError{Rule: i + 1, Want: prev.Target, Got: u.Source}
+			if DigestVersionOf(prev.Target) != DigestVersionOf(u.Source) && prev.TargetSQL == "" {
+				err = fmt.Errorf("%w (upgrade %d needs a TargetSQL to compare digest versions)", err, i)
+			}
+			errs = append(errs, err)
 		}
-		last = u.Target
 	}
-	if last != "" && last != hc {
-		errs = append(errs, fmt.Errorf("missing upgrade from %s to target %s", last, hc))
+	if n := len(s.Updates); n != 0 && s.Updates[n-1].Target != "" {
+		last := s.Updates[n-1].Target
+		if DigestVersionOf(last) != DigestVersionOf(hc) {
+			hc, err = SQLDigestVersion(s.Current, DigestVersionOf(last))
+		}
+		if err == nil && last != hc {
+			errs = append(errs, InconsistentChainError{Want: hc, Got: last})
+		}
 	}
 	return errors.Join(errs...)
 }
 
+// chained reports whether the Target of u is the schema with digest next.
+// Digests of different versions can be compared only if u has a TargetSQL,
+// so chained reports false if they differ in version and u has none.
+func chained(u UpdateRule, next string) bool {
+	if DigestVersionOf(u.Target) == DigestVersionOf(next) {
+		return u.Target == next
+	} else if u.TargetSQL == "" {
+		return false
+	}
+	d, err := SQLDigestVersion(u.TargetSQL, DigestVersionOf(next))
+	return err == nil && d == next
+}
+
 // History reports the history of schema upgrades recorded by db in
-// chronological order.
+// chronological order. It is equivalent to [ReadHistory] with nil options.
 func History(ctx context.Context, db DBConn) ([]HistoryRow, error) {
-	rows, err := db.QueryContext(ctx, queryHistoryRows)
+	return ReadHistory(ctx, db, nil)
+}
+
+// ReadHistory reports the history of schema upgrades recorded by db in the
+// history table named by opts, in chronological order. A nil opts is valid
+// and provides default options.
+func ReadHistory(ctx context.Context, db DBConn, opts *DigestOptions) ([]HistoryRow, error) {
+	// The history may have been written by an older version of this package,
+	// so substitute NULL for any columns that have not yet been added.
+	cols, err := historyColumns(ctx, db, opts)
+	if err != nil {
+		return nil, err
+	}
+	var extra []string
+	for _, c := range historyAddedColumns {
+		if cols.Has(c.Name) {
+			extra = append(extra, c.Name)
+		} else {
+			extra = append(extra, "NULL")
+		}
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(queryHistoryRows, opts.historyTableRef(), strings.Join(extra, ", ")))
 	if err != nil {
 		return nil, err
 	}
@@ -330,26 +1155,98 @@ func History(ctx context.Context, db DBConn) ([]HistoryRow, error) {
 		var ts int64
 		var digest string
 		var schemaBytes []byte
-		if err := rows.Scan(&ts, &digest, &schemaBytes); err != nil {
+		var note, rules sql.NullString
+		var elapsed sql.NullInt64
+		if err := rows.Scan(&ts, &digest, &schemaBytes, &note, &elapsed, &rules); err != nil {
 			return nil, fmt.Errorf("scan history: %w", err)
 		}
-		out = append(out, HistoryRow{
+		hr := HistoryRow{
 			Timestamp: time.UnixMicro(ts).UTC(),
 			Digest:    digest,
 			Schema:    uncompress(schemaBytes),
-		})
+			Note:      note.String,
+			Elapsed:   time.Duration(elapsed.Int64) * time.Microsecond,
+		}
+		if rules.String != "" {
+			for _, r := range strings.Split(rules.String, ",") {
+				v, err := strconv.Atoi(r)
+				if err != nil {
+					return nil, fmt.Errorf("scan history rules: %w", err)
+				}
+				hr.Rules = append(hr.Rules, v)
+			}
+		}
+		out = append(out, hr)
+	}
+	return out, nil
+}
+
+// readHistory reads the history of the database managed by db as ReadHistory
+// does, but reports an empty history if the history table does not exist.
+func (s *Schema) readHistory(ctx context.Context, db DBConn) ([]HistoryRow, error) {
+	opts := s.digestOptions()
+	if cols, err := historyColumns(ctx, db, opts); err != nil {
+		return nil, err
+	} else if cols.Len() == 0 {
+		return nil, nil
+	}
+	return ReadHistory(ctx, db, opts)
+}
+
+// historyColumns reports the names of the columns of the history table named
+// by opts, which are empty if the table does not exist.
+func historyColumns(ctx context.Context, db DBConn, opts *DigestOptions) (mapset.Set[string], error) {
+	cols, err := readColumns(ctx, db, opts.database(), opts.historyTable())
+	if err != nil {
+		return nil, err
+	}
+	out := mapset.New[string]()
+	for _, c := range cols {
+		out.Add(c.Name)
 	}
 	return out, nil
 }
 
+// upgradeHistory creates the history table named by opts if it does not
+// exist, and adds any columns missing from an existing table. It is called
+// only before the history is written, since reading the history does not
+// require the added columns (see ReadHistory).
+func upgradeHistory(ctx context.Context, db DBConn, opts *DigestOptions) error {
+	cols, err := historyColumns(ctx, db, opts)
+	if err != nil {
+		return err
+	} else if cols.Len() == 0 {
+		_, err := db.ExecContext(ctx, historyTableSQL(opts))
+		return err
+	}
+	for _, c := range historyAddedColumns {
+		if cols.Has(c.Name) {
+			continue
+		}
+		if _, err := db.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`,
+			opts.historyTableRef(), c.Name, c.Type)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // HistoryRow is a row in the schema history maintained by the [Schema] type.
 type HistoryRow struct {
-	Timestamp time.Time `json:"timestamp"`     // In UTC
-	Digest    string    `json:"digest"`        // The digest of the schema at this update
-	Schema    string    `json:"sql,omitempty"` // The SQL of the schema at this update
+	Timestamp time.Time `json:"timestamp"`      // In UTC
+	Digest    string    `json:"digest"`         // The digest of the schema at this update
+	Schema    string    `json:"sql,omitempty"`  // The SQL of the schema at this update
+	Note      string    `json:"note,omitempty"` // A description of a step that did not change the schema
+
+	// Elapsed is how long it took to reach this update, or 0 if unknown.
+	Elapsed time.Duration `json:"elapsed,omitempty"`
+
+	// Rules are the 1-based indexes of the update rules applied to reach this
+	// update, in the order they ran, or nil if none were recorded.
+	Rules []int `json:"rules,omitempty"`
 }
 
-func schemaDigest(sr []schemaRow) string {
+func schemaDigest(sr []schemaRow, v DigestVersion) string {
 	// N.B. We don't include the SQL in the hash for tables, since it can be
 	// mangled by ALTER TABLE executions. We rely on the Columns instead.
 	//
@@ -364,27 +1261,94 @@ func schemaDigest(sr []schemaRow) string {
 	}
 	h := sha256.New()
 	json.NewEncoder(h).Encode(sr)
-	return hex.EncodeToString(h.Sum(nil))
+	return v.tag() + hex.EncodeToString(h.Sum(nil))
 }
 
 // SQLDigest computes a hex-encoded SHA256 digest of the SQLite schema encoded
-// by the specified string.
-func SQLDigest(text string) (string, error) {
-	sr, err := schemaTextToRows(context.Background(), text)
+// by the specified string, using the default digest version.
+func SQLDigest(text string) (string, error) { return SQLDigestVersion(text, 0) }
+
+// SQLDigestVersion computes a hex-encoded SHA256 digest of the SQLite schema
+// encoded by the specified string, using digest version v. If v == 0, the
+// default version is used.
+func SQLDigestVersion(text string, v DigestVersion) (string, error) {
+	if v != 0 && !v.valid() {
+		return "", fmt.Errorf("unknown digest version %d", v)
+	}
+	sr, err := schemaTextToRows(context.Background(), text, v)
 	if err != nil {
 		return "", err
 	}
-	return schemaDigest(sr), nil
+	return schemaDigest(sr, cmp.Or(v, DigestV1)), nil
+}
+
+// A DigestVersion identifies an algorithm for computing schema digests.
+//
+// Digests computed by versions after DigestV1 begin with a tag giving the
+// version, such as "v2:", followed by the hexadecimal digest. DigestV1 digests
+// are untagged, so that digests computed before versions were introduced
+// remain valid. Use [DigestVersionOf] to find the version of a digest.
+//
+// The update rules of a [Schema] may use digests of different versions, so
+// that existing rules remain valid when the DigestVersion of the Schema
+// changes. Use [Schema.TranslateHistory] to translate the digests recorded in
+// the history of a database. See docs/digest.md for a description of each
+// version.
+type DigestVersion int
+
+const (
+	// DigestV1 is the original digest algorithm, which describes each table
+	// by the names, types, nullability, defaults, and primary key membership
+	// of its columns. It is the default.
+	DigestV1 DigestVersion = 1
+
+	// DigestV2 extends DigestV1 to also describe the collations of columns,
+	// the CHECK, UNIQUE, and FOREIGN KEY constraints of tables, and the
+	// STRICT and WITHOUT ROWID table options.
+	DigestV2 DigestVersion = 2
+)
+
+func (v DigestVersion) valid() bool { return v == DigestV1 || v == DigestV2 }
+
+// tag returns the prefix of digests computed by version v.
+func (v DigestVersion) tag() string {
+	if v == DigestV1 {
+		return ""
+	}
+	return fmt.Sprintf("v%d:", int(v))
+}
+
+// DigestVersionOf reports the version of the algorithm that computed digest,
+// according to its tag. An untagged digest has version DigestV1. It returns 0
+// if the tag is malformed.
+func DigestVersionOf(digest string) DigestVersion {
+	tag, _, ok := strings.Cut(digest, ":")
+	if !ok {
+		return DigestV1
+	}
+	num, ok := strings.CutPrefix(tag, "v")
+	if !ok {
+		return 0
+	}
+	v, err := strconv.Atoi(num)
+	if err != nil || v <= int(DigestV1) {
+		return 0
+	}
+	return DigestVersion(v)
+}
+
+func (s *Schema) sqlDigest(text string) (string, error) {
+	return SQLDigestVersion(text, s.DigestVersion)
 }
 
 // DBDigest computes a hex-encoded SHA256 digest of the SQLite schema encoded in
 // the specified database. A nil opts is valid and provides default options.
 func DBDigest(ctx context.Context, db DBConn, opts *DigestOptions) (string, error) {
-	sr, err := readSchema(ctx, db, "main", opts)
+	sr, err := readSchema(ctx, db, opts)
 	if err != nil {
 		return "", err
 	}
-	return schemaDigest(sr), nil
+	return schemaDigest(sr, opts.version()), nil
 }
 
 // DigestOptions are options for computing the schema digest of a SQLite database.
@@ -394,6 +1358,26 @@ type DigestOptions struct {
 	// computing the schema digest. By default, only the schema history table
 	// and sqlite sequence number tables are filtered.
 	IgnoreTables []string
+
+	// HistoryTable, if non-empty, is the name of the schema history table.
+	// The default is "_schema_history", or TablePrefix + "schema_history" if
+	// TablePrefix is set.
+	HistoryTable string
+
+	// TablePrefix, if non-empty, restricts the digest to tables and views
+	// whose names begin with this prefix, and indexes and triggers associated
+	// with them.
+	TablePrefix string
+
+	// Database, if non-empty, is the name of the attached database whose
+	// schema is read, and which contains the history table. The default is
+	// "main".
+	Database string
+
+	// Version, if non-zero, is the digest algorithm to use. The default is
+	// DigestV1. Validate and DiffDB also compare the properties recorded by
+	// the selected version.
+	Version DigestVersion
 }
 
 func (o *DigestOptions) ignoreTables() []string {
@@ -403,6 +1387,44 @@ func (o *DigestOptions) ignoreTables() []string {
 	return o.IgnoreTables
 }
 
+func (o *DigestOptions) historyTable() string {
+	if o == nil {
+		return historyTableName
+	} else if o.HistoryTable != "" {
+		return o.HistoryTable
+	} else if o.TablePrefix != "" {
+		return o.TablePrefix + "schema_history"
+	}
+	return historyTableName
+}
+
+// historyTableRef returns the quoted name of the history table, qualified by
+// the name of its database.
+func (o *DigestOptions) historyTableRef() string {
+	return quoteIdent(o.database()) + "." + quoteIdent(o.historyTable())
+}
+
+func (o *DigestOptions) version() DigestVersion {
+	if o == nil || o.Version == 0 {
+		return DigestV1
+	}
+	return o.Version
+}
+
+func (o *DigestOptions) database() string {
+	if o == nil || o.Database == "" {
+		return "main"
+	}
+	return o.Database
+}
+
+func (o *DigestOptions) tablePrefix() string {
+	if o == nil {
+		return ""
+	}
+	return o.TablePrefix
+}
+
 func compress(text string) []byte {
 	e, err := zstd.NewWriter(io.Discard)
 	if err != nil {
@@ -4,13 +4,18 @@
 package squibble_test
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"github.com/tailscale/squibble"
@@ -28,6 +33,21 @@ func mustOpenDB(t *testing.T) *sql.DB {
 	return db
 }
 
+// mustOpenReadOnly opens a second, read-only handle to the database file of db.
+func mustOpenReadOnly(t *testing.T, db *sql.DB) *sql.DB {
+	t.Helper()
+	var path string
+	if err := db.QueryRow(`SELECT file FROM pragma_database_list WHERE name = 'main'`).Scan(&path); err != nil {
+		t.Fatalf("Read database path: %v", err)
+	}
+	rdb, err := sql.Open("sqlite", "file://"+path+"?mode=ro")
+	if err != nil {
+		t.Fatalf("Open read-only database: %v", err)
+	}
+	t.Cleanup(func() { rdb.Close() })
+	return rdb
+}
+
 func mustTableSchema(t *testing.T, db *sql.DB, table string) string {
 	t.Helper()
 	var schema string
@@ -56,6 +76,15 @@ func mustHash(t *testing.T, text string) string {
 	return h
 }
 
+func mustHashVersion(t *testing.T, text string, v squibble.DigestVersion) string {
+	t.Helper()
+	h, err := squibble.SQLDigestVersion(text, v)
+	if err != nil {
+		t.Fatalf("SQLDigestVersion failed: %v", err)
+	}
+	return h
+}
+
 func TestEmptySchema(t *testing.T) {
 	db := mustOpenDB(t)
 
@@ -98,8 +127,8 @@ func TestUpgrade(t *testing.T) {
 		s := &squibble.Schema{
 			Current: v2,
 			Updates: []squibble.UpdateRule{
-				{mustHash(t, v1), mustHash(t, v2),
-					squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`)},
+				{Source: mustHash(t, v1), Target: mustHash(t, v2),
+					Apply: squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`)},
 			},
 			Logf: t.Logf,
 		}
@@ -113,10 +142,10 @@ func TestUpgrade(t *testing.T) {
 		s := &squibble.Schema{
 			Current: v3,
 			Updates: []squibble.UpdateRule{
-				{mustHash(t, v1), mustHash(t, v2),
-					squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`)},
-				{mustHash(t, v2), mustHash(t, v3),
-					squibble.Exec(`CREATE TABLE bar (z integer not null)`)},
+				{Source: mustHash(t, v1), Target: mustHash(t, v2),
+					Apply: squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`)},
+				{Source: mustHash(t, v2), Target: mustHash(t, v3),
+					Apply: squibble.Exec(`CREATE TABLE bar (z integer not null)`)},
 			},
 			Logf: t.Logf,
 		}
@@ -171,8 +200,8 @@ func TestUpgrade(t *testing.T) {
 		s := &squibble.Schema{
 			Current: v4,
 			Updates: []squibble.UpdateRule{
-				{mustHash(t, v3), mustHash(t, v4),
-					squibble.Exec(
+				{Source: mustHash(t, v3), Target: mustHash(t, v4),
+					Apply: squibble.Exec(
 						`DROP TABLE bar`,
 						`ALTER TABLE foo DROP COLUMN y`,
 						`ALTER TABLE foo ADD COLUMN z integer`,
@@ -235,18 +264,18 @@ create table bar (z integer not null)`
 			Updates: []squibble.UpdateRule{
 				// History: v1 → v2 → v3 → (v4 = v3) → v5 → (v6 = v3) → (v7 = v3)
 				// The cycle exercises the correct handling of repeats.
-				{mustHash(t, v1), mustHash(t, v2),
-					squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`)},
-				{mustHash(t, v2), mustHash(t, v3),
-					squibble.Exec(`CREATE TABLE bar (z integer not null)`)},
-				{mustHash(t, v3), mustHash(t, v4),
-					squibble.NoAction},
-				{mustHash(t, v4), mustHash(t, v5),
-					squibble.Exec(`DROP TABLE foo`)},
-				{mustHash(t, v5), mustHash(t, v6),
-					squibble.Exec(`CREATE TABLE foo (x text, y text)`)},
-				{mustHash(t, v6), mustHash(t, v7),
-					squibble.NoAction},
+				{Source: mustHash(t, v1), Target: mustHash(t, v2),
+					Apply: squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`)},
+				{Source: mustHash(t, v2), Target: mustHash(t, v3),
+					Apply: squibble.Exec(`CREATE TABLE bar (z integer not null)`)},
+				{Source: mustHash(t, v3), Target: mustHash(t, v4),
+					Apply: squibble.NoAction},
+				{Source: mustHash(t, v4), Target: mustHash(t, v5),
+					Apply: squibble.Exec(`DROP TABLE foo`)},
+				{Source: mustHash(t, v5), Target: mustHash(t, v6),
+					Apply: squibble.Exec(`CREATE TABLE foo (x text, y text)`)},
+				{Source: mustHash(t, v6), Target: mustHash(t, v7),
+					Apply: squibble.NoAction},
 			},
 			Logf: t.Logf,
 		}
@@ -327,6 +356,8 @@ func TestUnmanaged(t *testing.T) {
 		t.Error("Apply should have failed but did not")
 	} else if !strings.Contains(err.Error(), "unmanaged schema") {
 		t.Errorf("Apply: got %v, want unmanaged schema", err)
+	} else if !errors.Is(err, squibble.ErrUnmanagedSchema) {
+		t.Errorf("Apply: got %v, want %v", err, squibble.ErrUnmanagedSchema)
 	}
 }
 
@@ -335,18 +366,18 @@ func TestInconsistent(t *testing.T) {
 	bad1 := &squibble.Schema{
 		Current: "create table ok (a text)",
 		Updates: []squibble.UpdateRule{
-			{"", "def", tmp},    // missing source
-			{"abc", "", tmp},    // missing target
-			{"abc", "def", nil}, // missing func
+			{Source: "", Target: "def", Apply: tmp},    // missing source
+			{Source: "abc", Target: "", Apply: tmp},    // missing target
+			{Source: "abc", Target: "def", Apply: nil}, // missing func
 		},
 		Logf: t.Logf,
 	}
 	bad2 := &squibble.Schema{
 		Current: "create table ok (a text)",
 		Updates: []squibble.UpdateRule{
-			{"abc", "def", tmp},
-			{"ghi", "jkl", tmp}, // missing link from def to ghi
-			{"jkl", "mno", tmp}, // missing link to current
+			{Source: "abc", Target: "def", Apply: tmp},
+			{Source: "ghi", Target: "jkl", Apply: tmp}, // missing link from def to ghi
+			{Source: "jkl", Target: "mno", Apply: tmp}, // missing link to current
 		},
 		Logf: t.Logf,
 	}
@@ -407,3 +438,2150 @@ func TestCompatible(t *testing.T) {
 		}
 	})
 }
+
+func TestPlan(t *testing.T) {
+	db := mustOpenDB(t)
+
+	const v1 = `create table foo (x text)`
+	const v2 = `create table foo (x text, y text)`
+
+	t.Run("Init", func(t *testing.T) {
+		s := &squibble.Schema{Current: v1, Logf: t.Logf}
+		p, err := s.Plan(t.Context(), db)
+		if err != nil {
+			t.Fatalf("Plan: unexpected error: %v", err)
+		}
+		if p.Kind != squibble.PlanInit || p.Target != mustHash(t, v1) {
+			t.Errorf("Plan: got %v to %s, want %v to %s", p.Kind, p.Target, squibble.PlanInit, mustHash(t, v1))
+		}
+		if _, err := s.DryRun(t.Context(), db); err != nil {
+			t.Errorf("DryRun: unexpected error: %v", err)
+		}
+		if err := squibble.Validate(t.Context(), db, "", nil); err != nil {
+			t.Errorf("DryRun changed the database: %v", err)
+		}
+		if err := s.Apply(t.Context(), db); err != nil {
+			t.Fatalf("Apply v1: unexpected error: %v", err)
+		}
+	})
+
+	t.Run("UpToDate", func(t *testing.T) {
+		s := &squibble.Schema{Current: v1, Logf: t.Logf}
+		p, err := s.Plan(t.Context(), db)
+		if err != nil {
+			t.Fatalf("Plan: unexpected error: %v", err)
+		}
+		if p.Kind != squibble.PlanUpToDate || len(p.Updates) != 0 {
+			t.Errorf("Plan: got %v with %d updates, want %v", p.Kind, len(p.Updates), squibble.PlanUpToDate)
+		}
+	})
+
+	t.Run("Upgrade", func(t *testing.T) {
+		s := &squibble.Schema{
+			Current: v2,
+			Updates: []squibble.UpdateRule{
+				{Source: mustHash(t, v1), Target: mustHash(t, v2),
+					Apply: squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`)},
+			},
+			Logf: t.Logf,
+		}
+		p, err := s.Plan(t.Context(), db)
+		if err != nil {
+			t.Fatalf("Plan: unexpected error: %v", err)
+		}
+		if p.Kind != squibble.PlanUpgrade || p.Source != mustHash(t, v1) || len(p.Updates) != 1 {
+			t.Errorf("Plan: got %v from %s with %d updates, want %v from %s with 1",
+				p.Kind, p.Source, len(p.Updates), squibble.PlanUpgrade, mustHash(t, v1))
+		}
+		if _, err := s.DryRun(t.Context(), db); err != nil {
+			t.Errorf("DryRun: unexpected error: %v", err)
+		}
+		checkTableSchema(t, db, "foo", v1)
+	})
+
+	t.Run("BadUpgrade", func(t *testing.T) {
+		s := &squibble.Schema{
+			Current: v2,
+			Updates: []squibble.UpdateRule{
+				{Source: mustHash(t, v1), Target: mustHash(t, v2),
+					Apply: squibble.Exec(`ALTER TABLE foo ADD COLUMN z text`)},
+			},
+			Logf: t.Logf,
+		}
+		if _, err := s.DryRun(t.Context(), db); err == nil {
+			t.Error("DryRun should have failed, but did not")
+		} else {
+			t.Logf("DryRun: got expected error: %v", err)
+		}
+		checkTableSchema(t, db, "foo", v1)
+	})
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		s := &squibble.Schema{
+			Current: v2,
+			Updates: []squibble.UpdateRule{
+				{Source: mustHash(t, v1), Target: mustHash(t, v2),
+					Apply: squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`)},
+			},
+			Logf: t.Logf,
+		}
+		p, err := s.Plan(t.Context(), mustOpenReadOnly(t, db))
+		if err != nil {
+			t.Fatalf("Plan: unexpected error: %v", err)
+		}
+		if p.Kind != squibble.PlanUpgrade || len(p.Updates) != 1 {
+			t.Errorf("Plan: got %v with %d updates, want %v with 1", p.Kind, len(p.Updates), squibble.PlanUpgrade)
+		}
+
+		// Planning for an empty database does not create the history table.
+		empty := mustOpenDB(t)
+		if err := empty.Ping(); err != nil {
+			t.Fatalf("Ping: %v", err)
+		}
+		p, err = s.Plan(t.Context(), mustOpenReadOnly(t, empty))
+		if err != nil {
+			t.Fatalf("Plan empty: unexpected error: %v", err)
+		}
+		if p.Kind != squibble.PlanInit {
+			t.Errorf("Plan empty: got %v, want %v", p.Kind, squibble.PlanInit)
+		}
+		if _, err := squibble.History(t.Context(), empty); err == nil {
+			t.Error("History: got nil error, want missing table")
+		}
+	})
+}
+
+func TestLoadFS(t *testing.T) {
+	const v1 = `create table foo (x text)`
+	const v2 = `create table foo (x text, y text)`
+	const v3 = `create table foo (x text, y text); create table bar (z integer)`
+	const v4 = `create table foo (x text, y text); create table bar (z integer, w text)`
+
+	rule := func(src, dst, body string) *fstest.MapFile {
+		return &fstest.MapFile{Data: []byte(fmt.Sprintf(
+			"-- Source: %s\n-- Target: %s\n\n%s\n", mustHash(t, src), mustHash(t, dst), body,
+		))}
+	}
+	fsys := fstest.MapFS{
+		"db/schema.sql":          &fstest.MapFile{Data: []byte(v4)},
+		"db/001-add-y.sql":       rule(v1, v2, `ALTER TABLE foo ADD COLUMN y text;`),
+		"db/002-add-bar.sql":     rule(v2, v3, `CREATE TABLE bar (z integer);`),
+		"db/010-placeholder.sql": rule(v3, v4, `-- implemented in Go`),
+		"db/README.md":           &fstest.MapFile{Data: []byte("ignored")},
+	}
+
+	s, err := squibble.LoadFS(fsys, "db")
+	if err != nil {
+		t.Fatalf("LoadFS: unexpected error: %v", err)
+	}
+	if len(s.Updates) != 3 {
+		t.Fatalf("LoadFS: got %d updates, want 3", len(s.Updates))
+	}
+	s.Logf = t.Logf
+
+	db := mustOpenDB(t)
+	if _, err := db.Exec(v1); err != nil {
+		t.Fatalf("Initialize schema: %v", err)
+	}
+	init := &squibble.Schema{Current: v1, Logf: t.Logf}
+	if err := init.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v1: unexpected error: %v", err)
+	}
+
+	// Without the Go rule, the placeholder does not reach its target.
+	if err := s.Apply(t.Context(), db); err == nil {
+		t.Error("Apply should have failed, but did not")
+	}
+
+	if err := s.MergeRules(squibble.UpdateRule{
+		Source: mustHash(t, v3),
+		Target: mustHash(t, v4),
+		Apply: func(ctx context.Context, db squibble.DBConn) error {
+			_, err := db.ExecContext(ctx, `ALTER TABLE bar ADD COLUMN w text`)
+			return err
+		},
+	}); err != nil {
+		t.Fatalf("MergeRules: unexpected error: %v", err)
+	}
+	if err := s.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v4: unexpected error: %v", err)
+	}
+	checkTableSchema(t, db, "bar", `create table bar (z integer, w text)`)
+
+	if err := s.MergeRules(squibble.UpdateRule{Source: "abc", Target: "def"}); err == nil {
+		t.Error("MergeRules should have failed, but did not")
+	}
+}
+
+func TestLoadFSForeignKeyCheck(t *testing.T) {
+	const v1 = `create table p (id integer primary key)`
+	const v2 = v1 + `; create table c (pid integer references p (id));
+create trigger c_ins after insert on c begin
+  insert into p (id) select new.pid where new.pid > 100;
+  select case when new.pid < 0 then raise(abort, 'negative') end;
+end`
+
+	load := func(t *testing.T, data string) *squibble.Schema {
+		t.Helper()
+		s, err := squibble.LoadFS(fstest.MapFS{
+			"schema.sql": {Data: []byte(v2)},
+			"001-add-c.sql": {Data: []byte(fmt.Sprintf("-- Source: %s\n-- Target: %s\n\n%s",
+				mustHash(t, v1), mustHash(t, v2), v2[len(v1)+2:]+";\n"+data+"\nPRAGMA foreign_key_check;\n-- done\n"))},
+		}, ".")
+		if err != nil {
+			t.Fatalf("LoadFS: unexpected error: %v", err)
+		}
+		s.Logf = t.Logf
+		s.DisableForeignKeys = true
+		return s
+	}
+	newDB := func(t *testing.T) *sql.DB {
+		t.Helper()
+		db := mustOpenDB(t)
+		if err := (&squibble.Schema{Current: v1, Logf: t.Logf}).Apply(t.Context(), db); err != nil {
+			t.Fatalf("Apply v1: unexpected error: %v", err)
+		}
+		return db
+	}
+
+	t.Run("OK", func(t *testing.T) {
+		// The trigger adds the missing parent, so there is no violation.
+		db := newDB(t)
+		if err := load(t, `INSERT INTO c (pid) VALUES (101);`).Apply(t.Context(), db); err != nil {
+			t.Fatalf("Apply v2: unexpected error: %v", err)
+		}
+	})
+	t.Run("Violation", func(t *testing.T) {
+		db := newDB(t)
+		err := load(t, `INSERT INTO c (pid) VALUES (5);`).Apply(t.Context(), db)
+		var fe squibble.ForeignKeyError
+		if !errors.As(err, &fe) {
+			t.Fatalf("Apply v2: got %v, want %T", err, fe)
+		}
+		t.Logf("Apply: got expected error: %v", err)
+	})
+}
+
+func TestDiff(t *testing.T) {
+	const v1 = `create table foo (x text, y integer not null, z blob);
+create index foo_x on foo (x);
+create view vx as select x from foo`
+	const v2 = `create table foo (x text, y integer, w text default 'q');
+create view vx as select x, y from foo;
+create table bar (a integer primary key)`
+
+	d, err := squibble.DiffSQL(v1, v2)
+	if err != nil {
+		t.Fatalf("DiffSQL: unexpected error: %v", err)
+	}
+	t.Logf("Diff:\n%s", d)
+
+	var added, removed, modified []string
+	for _, o := range d.Added {
+		added = append(added, o.Type+" "+o.Name)
+	}
+	for _, o := range d.Removed {
+		removed = append(removed, o.Type+" "+o.Name)
+	}
+	var cols []string
+	for _, o := range d.Modified {
+		modified = append(modified, o.Type+" "+o.Name)
+		for _, c := range o.Columns {
+			switch {
+			case c.Old == nil:
+				cols = append(cols, "+"+c.Name)
+			case c.New == nil:
+				cols = append(cols, "-"+c.Name)
+			default:
+				cols = append(cols, "!"+c.Name+":"+strings.Join(c.Changed, ","))
+			}
+		}
+	}
+	check := func(label string, got []string, want ...string) {
+		t.Helper()
+		if strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("%s: got %q, want %q", label, got, want)
+		}
+	}
+	check("Added", added, "table bar")
+	check("Removed", removed, "index foo_x")
+	check("Modified", modified, "table foo", "view vx")
+	check("Columns", cols, "-z", "!y:notNull", "+w")
+
+	if d, err := squibble.DiffSQL(v1, "-- same\n"+v1); err != nil {
+		t.Fatalf("DiffSQL: unexpected error: %v", err)
+	} else if !d.IsEmpty() {
+		t.Errorf("DiffSQL: got %v, want empty", d)
+	}
+}
+
+func TestDraftUpdate(t *testing.T) {
+	tests := []struct {
+		name      string
+		old, new  string
+		unhandled bool
+	}{
+		{"AddColumn",
+			`create table foo (x text)`,
+			`create table foo (x text, y integer not null default 0)`, false},
+		{"DropColumn",
+			`create table foo (x text, y blob)`,
+			`create table foo (x text)`, false},
+		{"RenameColumn",
+			`create table foo (x text, y blob)`,
+			`create table foo (x text, z blob)`, false},
+		{"RenameTable",
+			`create table foo (x text, y blob)`,
+			`create table bar (x text, y blob)`, false},
+		{"Indexes",
+			`create table foo (x text, y integer); create index foo_x on foo (x); create index foo_y on foo(y)`,
+			`create table foo (x text, y integer); create index foo_y on foo(y, x); create index foo_xy on foo (x, y)`, false},
+		{"Views",
+			`create table foo (x text, y integer); create view v1 as select x from foo`,
+			`create table foo (x text, y integer); create view v1 as select x, y from foo; create view v2 as select y from foo`, false},
+		{"Rebuild",
+			`create table foo (x text, y integer);
+create index foo_x on foo (x);
+create view vfoo as select x, y from foo;
+create trigger tfoo after insert on foo begin select 1; end`,
+			`create table foo (x text not null, y integer);
+create index foo_x on foo (x);
+create view vfoo as select x, y from foo;
+create trigger tfoo after insert on foo begin select 1; end`, false},
+		{"RebuildNewColumn",
+			`create table foo (x text)`,
+			`create table foo (x text, y integer primary key)`, false},
+		{"Unhandled",
+			`create table foo (x text, y integer)`,
+			`create table foo (x text not null, y integer, z text not null)`, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db := mustOpenDB(t)
+			if _, err := db.Exec(tc.old); err != nil {
+				t.Fatalf("Initialize schema: %v", err)
+			}
+			if _, err := db.Exec(`INSERT INTO ` + strings.Fields(tc.old)[2] + ` (x) VALUES ('a'), ('b')`); err != nil {
+				t.Fatalf("Insert data: %v", err)
+			}
+
+			draft, err := squibble.DraftUpdate(t.Context(), db, tc.new, nil)
+			if err != nil {
+				t.Fatalf("DraftUpdate: unexpected error: %v", err)
+			}
+			for i, stmt := range draft.Stmts {
+				t.Logf("Stmt %d: %s", i+1, stmt)
+			}
+			if got := len(draft.Unhandled) != 0; got != tc.unhandled {
+				t.Fatalf("Unhandled: got %q, want %v", draft.Unhandled, tc.unhandled)
+			} else if got {
+				t.Logf("Unhandled: %q", draft.Unhandled)
+				return
+			}
+
+			if err := squibble.Exec(draft.Stmts...)(t.Context(), db); err != nil {
+				t.Fatalf("Exec draft: %v", err)
+			}
+			if err := squibble.Validate(t.Context(), db, tc.new, nil); err != nil {
+				t.Errorf("Validate: %v", err)
+			}
+			var n int
+			if err := db.QueryRow(`SELECT count(*) FROM ` + strings.Fields(tc.new)[2]).Scan(&n); err != nil {
+				t.Fatalf("Count rows: %v", err)
+			} else if n != 2 {
+				t.Errorf("Got %d rows, want 2", n)
+			}
+		})
+	}
+}
+
+func TestDraftVerify(t *testing.T) {
+	t.Run("Renames", func(t *testing.T) {
+		for _, tc := range []struct{ old, new, want string }{
+			{`create table foo (x text, y blob)`, `create table foo (x text, z blob)`,
+				`-- verify: inferred rename of column "y" to "z"`},
+			{`create table foo (x text, y blob)`, `create table bar (x text, y blob)`,
+				`-- verify: inferred rename of table "foo" to "bar"`},
+			{`create table foo (x text, y blob)`, `create table foo (x text not null, z blob)`,
+				`-- verify: inferred rename of column "y" to "z"`}, // with a rebuild
+		} {
+			db := mustOpenDB(t)
+			if _, err := db.Exec(tc.old); err != nil {
+				t.Fatalf("Initialize schema: %v", err)
+			}
+			draft, err := squibble.DraftUpdate(t.Context(), db, tc.new, nil)
+			if err != nil {
+				t.Fatalf("DraftUpdate: unexpected error: %v", err)
+			}
+			if !slices.ContainsFunc(draft.Stmts, func(s string) bool { return strings.HasPrefix(s, tc.want+"\n") }) {
+				t.Errorf("Draft %q: no statement begins with %q", draft.Stmts, tc.want)
+			}
+			if err := squibble.Exec(draft.Stmts...)(t.Context(), db); err != nil {
+				t.Fatalf("Exec draft: %v", err)
+			}
+			if err := squibble.Validate(t.Context(), db, tc.new, nil); err != nil {
+				t.Errorf("Validate: %v", err)
+			}
+		}
+	})
+
+	t.Run("ForeignKeys", func(t *testing.T) {
+		const v1 = `create table p (id integer primary key); create table c (x text, p integer references p (id))`
+		const v2 = `create table p (id integer primary key); create table c (x text not null, p integer references p (id))`
+
+		// Foreign keys are not enforced by default, so this row is accepted.
+		db := mustOpenDB(t)
+		if _, err := db.Exec(v1); err != nil {
+			t.Fatalf("Initialize schema: %v", err)
+		}
+		if _, err := db.Exec(`INSERT INTO c (x, p) VALUES ('a', 5)`); err != nil {
+			t.Fatalf("Insert data: %v", err)
+		}
+		draft, err := squibble.DraftUpdate(t.Context(), db, v2, nil)
+		if err != nil {
+			t.Fatalf("DraftUpdate: unexpected error: %v", err)
+		}
+		if !slices.Contains(draft.Stmts, `PRAGMA foreign_key_check("c")`) {
+			t.Errorf("Draft %q: missing foreign key check", draft.Stmts)
+		}
+		err = squibble.Exec(draft.Stmts...)(t.Context(), db)
+		var fke squibble.ForeignKeyError
+		if !errors.As(err, &fke) || len(fke.Violations) != 1 {
+			t.Fatalf("Exec draft: got %v, want 1 foreign key violation", err)
+		}
+		t.Logf("Exec draft: got expected error: %v", err)
+	})
+
+	t.Run("RebuildScope", func(t *testing.T) {
+		// Only the views and triggers that depend on the rebuilt table are
+		// dropped and re-created.
+		const tail = `create table bar (y integer);
+create view vfoo as select x from foo;
+create view vvfoo as select * from vfoo;
+create view vbar as select y from bar;
+create trigger tbar after insert on bar begin select 1; end`
+		const v1 = `create table foo (x text);` + tail
+		const v2 = `create table foo (x text not null);` + tail
+
+		db := mustOpenDB(t)
+		if _, err := db.Exec(v1); err != nil {
+			t.Fatalf("Initialize schema: %v", err)
+		}
+		draft, err := squibble.DraftUpdate(t.Context(), db, v2, nil)
+		if err != nil {
+			t.Fatalf("DraftUpdate: unexpected error: %v", err)
+		}
+		for _, want := range []string{`DROP VIEW "vfoo"`, `DROP VIEW "vvfoo"`} {
+			if !slices.Contains(draft.Stmts, want) {
+				t.Errorf("Draft %q: missing %q", draft.Stmts, want)
+			}
+		}
+		for _, bad := range []string{`DROP VIEW "vbar"`, `DROP TRIGGER "tbar"`} {
+			if slices.Contains(draft.Stmts, bad) {
+				t.Errorf("Draft %q: unexpected %q", draft.Stmts, bad)
+			}
+		}
+		if err := squibble.Exec(draft.Stmts...)(t.Context(), db); err != nil {
+			t.Fatalf("Exec draft: %v", err)
+		}
+		if err := squibble.Validate(t.Context(), db, v2, nil); err != nil {
+			t.Errorf("Validate: %v", err)
+		}
+	})
+
+	t.Run("AddColumnConstraints", func(t *testing.T) {
+		// Under DigestV1, the constraints of a new column are not recorded in
+		// the schema, but the draft must still preserve them.
+		const v1 = `create table p (id integer primary key); create table c (x text)`
+		for _, col := range []string{
+			`p integer references p (id)`,
+			`n integer default 0 check (n >= 0)`,
+			`s text collate nocase`,
+		} {
+			v2 := `create table p (id integer primary key); create table c (x text, ` + col + `)`
+			db := mustOpenDB(t)
+			if _, err := db.Exec(v1); err != nil {
+				t.Fatalf("Initialize schema: %v", err)
+			}
+			draft, err := squibble.DraftUpdate(t.Context(), db, v2, nil)
+			if err != nil {
+				t.Fatalf("DraftUpdate: unexpected error: %v", err)
+			}
+			want := `ALTER TABLE "c" ADD COLUMN ` + col
+			if !slices.Contains(draft.Stmts, want) {
+				t.Errorf("Draft %q: missing %q", draft.Stmts, want)
+			}
+			if err := squibble.Exec(draft.Stmts...)(t.Context(), db); err != nil {
+				t.Fatalf("Exec draft: %v", err)
+			}
+			opts := &squibble.DigestOptions{Version: squibble.DigestV2}
+			if err := squibble.Validate(t.Context(), db, v2, opts); err != nil {
+				t.Errorf("Validate V2: %v", err)
+			}
+		}
+	})
+}
+
+func TestRebuildTable(t *testing.T) {
+	const v1 = `create table foo (id integer primary key, x text, y integer);
+create index foo_x on foo (x);
+create view vfoo as select x, y from foo;
+create table bar (a integer references foo (id));
+create trigger tbar after insert on bar begin update foo set y = y + 1 where id = new.a; end`
+	const v2 = `create table foo (id integer primary key, x text not null, y integer);
+create index foo_x on foo (x);
+create view vfoo as select x, y from foo;
+create table bar (a integer references foo (id));
+create trigger tbar after insert on bar begin update foo set y = y + 1 where id = new.a; end`
+	const v3 = `create table foo (id integer primary key, x text not null, z integer);
+create index foo_x on foo (x);
+create view vfoo as select x, z from foo;
+create table bar (a integer references foo (id));
+create trigger tbar after insert on bar begin update foo set z = z || '+' where id = new.a; end`
+
+	db := mustOpenDB(t)
+	s := &squibble.Schema{Current: v1, Logf: t.Logf}
+	if err := s.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v1: unexpected error: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO foo (id, x, y) VALUES (1, 'a', 10), (2, 'b', 20); INSERT INTO bar (a) VALUES (1)`); err != nil {
+		t.Fatalf("Insert data: %v", err)
+	}
+
+	s.Current = v3
+	s.Updates = []squibble.UpdateRule{
+		{Source: mustHash(t, v1), Target: mustHash(t, v2),
+			Apply: squibble.RebuildTable("foo", `CREATE TABLE foo (id integer primary key, x text not null, y integer)`, nil)},
+		{Source: mustHash(t, v2), Target: mustHash(t, v3),
+			Apply: squibble.Exec(
+				`DROP TRIGGER tbar`, `DROP VIEW vfoo`,
+				`ALTER TABLE foo RENAME COLUMN y TO z`,
+				`CREATE VIEW vfoo as select x, z from foo`,
+				`CREATE TRIGGER tbar after insert on bar begin update foo set z = z || '+' where id = new.a; end`,
+			)},
+	}
+	if err := s.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v3: unexpected error: %v", err)
+	}
+
+	var got string
+	if err := db.QueryRow(`SELECT group_concat(x || ':' || z, ',') FROM vfoo`).Scan(&got); err != nil {
+		t.Fatalf("Query view: %v", err)
+	} else if want := "a:11,b:20"; got != want {
+		t.Errorf("Query view: got %q, want %q", got, want)
+	}
+
+	t.Run("ColumnMap", func(t *testing.T) {
+		const v4 = `create table foo (id integer primary key, x text not null, z integer);
+create index foo_x on foo (x);
+create view vfoo as select x, z from foo;
+create table bar (a integer references foo (id), b text);
+create trigger tbar after insert on bar begin update foo set z = z || '+' where id = new.a; end`
+
+		s.Current = v4
+		s.Updates = append(s.Updates, squibble.UpdateRule{
+			Source: mustHash(t, v3),
+			Target: mustHash(t, v4),
+			Apply: squibble.RebuildTable("bar", `CREATE TABLE bar (a integer references foo (id), b text)`,
+				map[string]string{"a": "a", "b": "'x' || a"}),
+		})
+		if err := s.Apply(t.Context(), db); err != nil {
+			t.Fatalf("Apply v4: unexpected error: %v", err)
+		}
+		if err := db.QueryRow(`SELECT b FROM bar`).Scan(&got); err != nil {
+			t.Fatalf("Query bar: %v", err)
+		} else if got != "x1" {
+			t.Errorf("Query bar: got %q, want x1", got)
+		}
+	})
+
+	t.Run("Dependents", func(t *testing.T) {
+		db := mustOpenDB(t)
+		if _, err := db.Exec(`create table foo (x text); create table other (y text);
+create view vfoo as select x from foo;
+create view vvfoo as select x from vfoo;
+create view vother as select y from other;
+create trigger tother after insert on other begin select 1; end`); err != nil {
+			t.Fatalf("Initialize schema: %v", err)
+		}
+		rowids := func() map[string]int64 {
+			rows, err := db.Query(`SELECT name, rowid FROM sqlite_schema`)
+			if err != nil {
+				t.Fatalf("Read schema: %v", err)
+			}
+			defer rows.Close()
+			out := make(map[string]int64)
+			for rows.Next() {
+				var name string
+				var id int64
+				if err := rows.Scan(&name, &id); err != nil {
+					t.Fatalf("Scan schema: %v", err)
+				}
+				out[name] = id
+			}
+			return out
+		}
+		before := rowids()
+		rebuild := squibble.RebuildTable("foo", `CREATE TABLE foo (x text not null)`, nil)
+		if err := rebuild(t.Context(), db); err != nil {
+			t.Fatalf("RebuildTable: unexpected error: %v", err)
+		}
+		after := rowids()
+
+		// The views that depend on foo are re-created, but the objects that
+		// do not depend on it are untouched.
+		for _, name := range []string{"vfoo", "vvfoo"} {
+			if after[name] == before[name] {
+				t.Errorf("View %q was not re-created", name)
+			}
+		}
+		for _, name := range []string{"other", "vother", "tother"} {
+			if after[name] != before[name] {
+				t.Errorf("Object %q was re-created (rowid %d, was %d)", name, after[name], before[name])
+			}
+		}
+	})
+
+	t.Run("ForeignKeyViolation", func(t *testing.T) {
+		if _, err := db.Exec(`INSERT INTO bar (a) VALUES (99)`); err != nil {
+			t.Fatalf("Insert data: %v", err)
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatalf("Begin: %v", err)
+		}
+		defer tx.Rollback()
+		rebuild := squibble.RebuildTable("bar", `CREATE TABLE bar (a integer references foo (id), b text)`, nil)
+		if err := rebuild(t.Context(), tx); err == nil {
+			t.Error("RebuildTable should have failed, but did not")
+		} else {
+			t.Logf("RebuildTable: got expected error: %v", err)
+		}
+	})
+}
+
+func TestForeignKeys(t *testing.T) {
+	const v1 = `create table foo (id integer primary key, x text);
+create table bar (a integer references foo (id))`
+	const v2 = `create table foo (id integer primary key, x text not null);
+create table bar (a integer references foo (id))`
+	const v3 = `create table foo (id integer primary key, x text not null, y text);
+create table bar (a integer references foo (id))`
+
+	db := mustOpenDB(t)
+	db.SetMaxOpenConns(1) // so the pragma sticks
+	if _, err := db.Exec(`PRAGMA foreign_keys = ON`); err != nil {
+		t.Fatalf("Enable foreign keys: %v", err)
+	}
+	s := &squibble.Schema{Current: v1, Logf: t.Logf}
+	if err := s.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v1: unexpected error: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO foo (id, x) VALUES (1, 'a'); INSERT INTO bar (a) VALUES (1)`); err != nil {
+		t.Fatalf("Insert data: %v", err)
+	}
+
+	checkEnabled := func(t *testing.T) {
+		t.Helper()
+		var on bool
+		if err := db.QueryRow(`PRAGMA foreign_keys`).Scan(&on); err != nil {
+			t.Fatalf("Read foreign_keys: %v", err)
+		} else if !on {
+			t.Error("Foreign keys are not enabled")
+		}
+	}
+
+	rebuild := squibble.RebuildTable("foo", `CREATE TABLE foo (id integer primary key, x text not null)`, nil)
+	s.Current = v2
+	s.Updates = []squibble.UpdateRule{{Source: mustHash(t, v1), Target: mustHash(t, v2), Apply: rebuild}}
+
+	t.Run("Enforced", func(t *testing.T) {
+		if err := s.Apply(t.Context(), db); err == nil {
+			t.Error("Apply should have failed, but did not")
+		} else {
+			t.Logf("Apply: got expected error: %v", err)
+		}
+		checkEnabled(t)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		s.DisableForeignKeys = true
+		if err := s.Apply(t.Context(), db); err != nil {
+			t.Fatalf("Apply v2: unexpected error: %v", err)
+		}
+		checkEnabled(t)
+	})
+
+	t.Run("Violation", func(t *testing.T) {
+		s.Current = v3
+		s.Updates = append(s.Updates, squibble.UpdateRule{
+			Source: mustHash(t, v2),
+			Target: mustHash(t, v3),
+			Apply: squibble.Exec(
+				`ALTER TABLE foo ADD COLUMN y text`,
+				`DELETE FROM foo WHERE id = 1`,
+			),
+		})
+		err := s.Apply(t.Context(), db)
+		var fe squibble.ForeignKeyError
+		if !errors.As(err, &fe) {
+			t.Fatalf("Apply: got %v, want %T", err, fe)
+		}
+		if len(fe.Violations) != 1 || fe.Violations[0].Table != "bar" || fe.Violations[0].Parent != "foo" {
+			t.Errorf("Apply: got violations %+v, want bar -> foo", fe.Violations)
+		}
+		t.Logf("Apply: got expected error: %v", err)
+		checkEnabled(t)
+	})
+}
+
+func TestOutsideTx(t *testing.T) {
+	const v1 = `create table foo (x text)`
+	const v2 = `create table foo (x text, y text)`
+
+	db := mustOpenDB(t)
+	s := &squibble.Schema{Current: v1, Logf: t.Logf}
+	if err := s.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v1: unexpected error: %v", err)
+	}
+
+	s.Current = v2
+	s.Updates = []squibble.UpdateRule{{
+		Source: mustHash(t, v1),
+		Target: mustHash(t, v2),
+		Apply:  squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`),
+
+		// Neither of these steps is permitted inside a transaction.
+		BeforeTx: squibble.Exec(`PRAGMA auto_vacuum = FULL`),
+		AfterTx:  squibble.Exec(`VACUUM`),
+	}}
+	if err := s.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v2: unexpected error: %v", err)
+	}
+
+	// The auto_vacuum setting takes effect after a VACUUM.
+	var mode int
+	if err := db.QueryRow(`PRAGMA auto_vacuum`).Scan(&mode); err != nil {
+		t.Fatalf("Read auto_vacuum: %v", err)
+	} else if mode != 1 {
+		t.Errorf("auto_vacuum: got %d, want 1", mode)
+	}
+
+	hr, err := squibble.History(t.Context(), db)
+	if err != nil {
+		t.Fatalf("History: unexpected error: %v", err)
+	}
+	var notes []string
+	for _, h := range hr {
+		t.Logf("%s %s %q", h.Timestamp.Format(time.RFC3339Nano), h.Digest, h.Note)
+		if h.Note != "" {
+			notes = append(notes, h.Note)
+		}
+	}
+	if len(notes) != 3 || !strings.HasPrefix(notes[0], "before") ||
+		!strings.HasPrefix(notes[1], "pending after") || !strings.HasPrefix(notes[2], "after") {
+		t.Errorf("History notes: got %q, want before, pending after, and after", notes)
+	}
+}
+
+func TestAfterTxRetry(t *testing.T) {
+	const v1 = `create table foo (x text)`
+	const v2 = `create table foo (x text, y text)`
+
+	db := mustOpenDB(t)
+	s := &squibble.Schema{Current: v1, Logf: t.Logf}
+	if err := s.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v1: unexpected error: %v", err)
+	}
+
+	var calls int
+	fail := errors.New("after failed")
+	s.Current = v2
+	s.Updates = []squibble.UpdateRule{{
+		Source: mustHash(t, v1),
+		Target: mustHash(t, v2),
+		Apply:  squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`),
+		AfterTx: func(ctx context.Context, db squibble.DBConn) error {
+			calls++
+			if calls == 1 {
+				return fail
+			}
+			return nil
+		},
+	}}
+
+	// The first attempt reports the failure, but keeps the update.
+	if err := s.Apply(t.Context(), db); !errors.Is(err, fail) {
+		t.Fatalf("Apply v2: got %v, want %v", err, fail)
+	}
+	if got, err := squibble.DBDigest(t.Context(), db, nil); err != nil {
+		t.Fatalf("DBDigest: unexpected error: %v", err)
+	} else if want := mustHash(t, v2); got != want {
+		t.Errorf("DBDigest: got %s, want %s", got, want)
+	}
+
+	// The next call to Apply runs the pending step again, and after it
+	// succeeds, it is no longer pending.
+	for i := range 2 {
+		if err := s.Apply(t.Context(), db); err != nil {
+			t.Fatalf("Apply %d: unexpected error: %v", i+1, err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("AfterTx: got %d calls, want 2", calls)
+	}
+}
+
+func TestHistoryUpgrade(t *testing.T) {
+	const v1 = `create table foo (x text)`
+	const v2 = `create table foo (x text, y text)`
+
+	// Simulate a history table written by an older version of the package.
+	db := mustOpenDB(t)
+	if _, err := db.Exec(v1); err != nil {
+		t.Fatalf("Initialize schema: %v", err)
+	}
+	if _, err := db.Exec(`CREATE TABLE _schema_history (
+  timestamp INTEGER UNIQUE NOT NULL, digest TEXT NOT NULL, schema BLOB)`); err != nil {
+		t.Fatalf("Create history: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO _schema_history VALUES (1, ?, NULL)`, mustHash(t, v1)); err != nil {
+		t.Fatalf("Insert history: %v", err)
+	}
+	if hr, err := squibble.History(t.Context(), db); err != nil {
+		t.Fatalf("History: unexpected error: %v", err)
+	} else if len(hr) != 1 {
+		t.Fatalf("History: got %d rows, want 1", len(hr))
+	}
+
+	// A read-only database at the current schema does not need to be
+	// upgraded, even if there are steps outside the transaction.
+	t.Run("ReadOnly", func(t *testing.T) {
+		rdb := mustOpenReadOnly(t, db)
+		s := &squibble.Schema{
+			Current: v1,
+			Updates: []squibble.UpdateRule{{
+				Source:   mustHash(t, `create table bar (y text)`),
+				Target:   mustHash(t, v1),
+				Apply:    squibble.Exec(`DROP TABLE bar`, `CREATE TABLE foo (x text)`),
+				BeforeTx: squibble.Exec(`PRAGMA auto_vacuum = FULL`),
+				AfterTx:  squibble.Exec(`VACUUM`),
+			}},
+			Logf: t.Logf,
+		}
+		if _, err := s.Plan(t.Context(), rdb); err != nil {
+			t.Errorf("Plan: unexpected error: %v", err)
+		}
+		if err := s.Apply(t.Context(), rdb); err != nil {
+			t.Errorf("Apply: unexpected error: %v", err)
+		}
+	})
+
+	s := &squibble.Schema{
+		Current: v2,
+		Updates: []squibble.UpdateRule{{
+			Source: mustHash(t, v1),
+			Target: mustHash(t, v2),
+			Apply:  squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`),
+		}},
+		Logf: t.Logf,
+	}
+	if err := s.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v2: unexpected error: %v", err)
+	}
+	if hr, err := squibble.History(t.Context(), db); err != nil {
+		t.Fatalf("History: unexpected error: %v", err)
+	} else if len(hr) != 2 || hr[1].Digest != mustHash(t, v2) {
+		t.Errorf("History: got %+v, want 2 rows ending at v2", hr)
+	}
+}
+
+func TestCommitEachRule(t *testing.T) {
+	const v1 = `create table foo (x text)`
+	const v2 = `create table foo (x text, y text)`
+	const v3 = `create table foo (x text, y text, z text)`
+
+	db := mustOpenDB(t)
+	s := &squibble.Schema{Current: v1, Logf: t.Logf, CommitEachRule: true}
+	if err := s.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v1: unexpected error: %v", err)
+	}
+
+	// The second update is broken, but the first should still be committed.
+	s.Current = v3
+	s.Updates = []squibble.UpdateRule{{
+		Source: mustHash(t, v1),
+		Target: mustHash(t, v2),
+		Apply:  squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`),
+	}, {
+		Source: mustHash(t, v2),
+		Target: mustHash(t, v3),
+		Apply:  squibble.Exec(`ALTER TABLE foo ADD COLUMN z text`, `SELECT nonesuch FROM foo`),
+	}}
+	if err := s.Apply(t.Context(), db); err == nil {
+		t.Fatal("Apply v3: got nil, want error")
+	}
+	if got, err := squibble.DBDigest(t.Context(), db, nil); err != nil {
+		t.Fatalf("DBDigest: unexpected error: %v", err)
+	} else if want := mustHash(t, v2); got != want {
+		t.Errorf("DBDigest: got %s, want %s", got, want)
+	}
+	hr, err := squibble.History(t.Context(), db)
+	if err != nil {
+		t.Fatalf("History: unexpected error: %v", err)
+	} else if len(hr) != 2 || hr[1].Digest != mustHash(t, v2) {
+		t.Fatalf("History: got %+v, want 2 rows ending at v2", hr)
+	}
+
+	// Fixing the broken rule resumes from where the previous attempt stopped.
+	s.Updates[0].Apply = func(context.Context, squibble.DBConn) error {
+		t.Error("Update 1 should not be applied again")
+		return nil
+	}
+	s.Updates[1].Apply = squibble.Exec(`ALTER TABLE foo ADD COLUMN z text`)
+	if err := s.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v3: unexpected error: %v", err)
+	}
+	if err := squibble.Validate(t.Context(), db, v3, nil); err != nil {
+		t.Errorf("Validate: unexpected error: %v", err)
+	}
+	if hr, err := squibble.History(t.Context(), db); err != nil {
+		t.Fatalf("History: unexpected error: %v", err)
+	} else if len(hr) != 3 || hr[2].Schema != v3 {
+		t.Errorf("History: got %+v, want 3 rows ending at v3", hr)
+	}
+}
+
+func TestApplyTo(t *testing.T) {
+	const v1 = `create table foo (x text)`
+	const v2 = `create table foo (x text, y text)`
+	const v3 = `create table foo (x text, y text); create table bar (z integer)`
+
+	db := mustOpenDB(t)
+	s := &squibble.Schema{
+		Current: v3,
+		Updates: []squibble.UpdateRule{{
+			Source: mustHash(t, v1),
+			Target: mustHash(t, v2),
+			Apply:  squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`),
+			Revert: squibble.Exec(`ALTER TABLE foo DROP COLUMN y`),
+		}, {
+			Source: mustHash(t, v2),
+			Target: mustHash(t, v3),
+			Apply:  squibble.Exec(`CREATE TABLE bar (z integer)`),
+			Revert: squibble.Exec(`DROP TABLE bar`),
+		}},
+		Logf: t.Logf,
+	}
+	checkAt := func(t *testing.T, schema string) {
+		t.Helper()
+		if err := squibble.Validate(t.Context(), db, schema, nil); err != nil {
+			t.Errorf("Validate: unexpected error: %v", err)
+		}
+		hr, err := squibble.History(t.Context(), db)
+		if err != nil {
+			t.Fatalf("History: unexpected error: %v", err)
+		}
+		if got, want := hr[len(hr)-1].Digest, mustHash(t, schema); got != want {
+			t.Errorf("Latest history digest: got %s, want %s", got, want)
+		}
+	}
+
+	var ue squibble.UnmanagedSchemaError
+	if err := s.ApplyTo(t.Context(), db, mustHash(t, v2)); !errors.As(err, &ue) {
+		t.Errorf("ApplyTo on unmanaged database: got %v, want UnmanagedSchemaError", err)
+	} else if !errors.Is(err, squibble.ErrUnmanagedSchema) || !ue.Empty {
+		t.Errorf("ApplyTo on unmanaged database: got %v, want %v for empty database", err, squibble.ErrUnmanagedSchema)
+	}
+	if err := s.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v3: unexpected error: %v", err)
+	}
+
+	t.Run("Revert", func(t *testing.T) {
+		if err := s.ApplyTo(t.Context(), db, mustHash(t, v1)); err != nil {
+			t.Fatalf("ApplyTo v1: unexpected error: %v", err)
+		}
+		checkAt(t, v1)
+	})
+	t.Run("Forward", func(t *testing.T) {
+		if err := s.ApplyTo(t.Context(), db, mustHash(t, v2)); err != nil {
+			t.Fatalf("ApplyTo v2: unexpected error: %v", err)
+		}
+		checkAt(t, v2)
+	})
+	t.Run("Unknown", func(t *testing.T) {
+		if err := s.ApplyTo(t.Context(), db, mustHash(t, `create table nonesuch (q)`)); err == nil {
+			t.Error("ApplyTo unknown digest: got nil, want error")
+		}
+		checkAt(t, v2)
+	})
+	t.Run("Current", func(t *testing.T) {
+		if err := s.ApplyTo(t.Context(), db, mustHash(t, v3)); err != nil {
+			t.Fatalf("ApplyTo v3: unexpected error: %v", err)
+		}
+		checkAt(t, v3)
+	})
+	t.Run("BadRevert", func(t *testing.T) {
+		old := s.Updates[1].Revert
+		defer func() { s.Updates[1].Revert = old }()
+		s.Updates[1].Revert = squibble.NoAction
+
+		err := s.ApplyTo(t.Context(), db, mustHash(t, v2))
+		var te squibble.TargetMismatchError
+		if !errors.As(err, &te) {
+			t.Fatalf("ApplyTo with bad revert: got %v, want TargetMismatchError", err)
+		} else if !errors.Is(err, squibble.ErrTargetMismatch) {
+			t.Errorf("ApplyTo with bad revert: got %v, want %v", err, squibble.ErrTargetMismatch)
+		}
+		if !te.Revert || te.Rule != 2 || te.Got != mustHash(t, v3) || te.Source != mustHash(t, v2) {
+			t.Errorf("TargetMismatchError: got rule %d revert %v from %s, want revert of rule 2 from v3",
+				te.Rule, te.Revert, te.Got)
+		}
+		t.Logf("Error: %v", err)
+		checkAt(t, v3)
+	})
+	t.Run("FailedRevert", func(t *testing.T) {
+		old := s.Updates[1].Revert
+		defer func() { s.Updates[1].Revert = old }()
+		errBoom := errors.New("boom")
+		s.Updates[1].Revert = func(context.Context, squibble.DBConn) error { return errBoom }
+
+		err := s.ApplyTo(t.Context(), db, mustHash(t, v2))
+		var re squibble.RuleFailedError
+		if !errors.As(err, &re) {
+			t.Fatalf("ApplyTo with failed revert: got %v, want RuleFailedError", err)
+		} else if !errors.Is(err, squibble.ErrRuleFailed) || !errors.Is(err, errBoom) {
+			t.Errorf("ApplyTo with failed revert: got %v, want %v wrapping %v", err, squibble.ErrRuleFailed, errBoom)
+		}
+		if !re.Revert || re.Rule != 2 {
+			t.Errorf("RuleFailedError: got %+v, want revert of rule 2", re)
+		}
+		checkAt(t, v3)
+	})
+	t.Run("Ahead", func(t *testing.T) {
+		const v4 = v3 + `; create table baz (q text)`
+		newer := &squibble.Schema{
+			Current: v4,
+			Updates: append(slices.Clone(s.Updates), squibble.UpdateRule{
+				Source: mustHash(t, v3),
+				Target: mustHash(t, v4),
+				Apply:  squibble.Exec(`CREATE TABLE baz (q text)`),
+			}),
+			Logf: t.Logf,
+		}
+		db := mustOpenDB(t)
+		if err := s.Apply(t.Context(), db); err != nil {
+			t.Fatalf("Apply v3: unexpected error: %v", err)
+		}
+		if err := newer.Apply(t.Context(), db); err != nil {
+			t.Fatalf("Apply v4: unexpected error: %v", err)
+		}
+
+		err := s.ApplyTo(t.Context(), db, mustHash(t, v2))
+		var ae squibble.SchemaAheadError
+		if !errors.As(err, &ae) {
+			t.Fatalf("ApplyTo ahead: got %v, want SchemaAheadError", err)
+		} else if !errors.Is(err, squibble.ErrSchemaAhead) {
+			t.Errorf("ApplyTo ahead: got %v, want %v", err, squibble.ErrSchemaAhead)
+		}
+		if ae.Current != mustHash(t, v3) {
+			t.Errorf("SchemaAheadError: got current %s, want %s", ae.Current, mustHash(t, v3))
+		}
+	})
+	t.Run("NoRevert", func(t *testing.T) {
+		old := s.Updates[0].Revert
+		defer func() { s.Updates[0].Revert = old }()
+		s.Updates[0].Revert = nil
+
+		if err := s.ApplyTo(t.Context(), db, mustHash(t, v1)); err == nil {
+			t.Error("ApplyTo without revert: got nil, want error")
+		}
+		checkAt(t, v3)
+	})
+	t.Run("AfterTx", func(t *testing.T) {
+		var calls int
+		after := *s
+		after.Updates = slices.Clone(s.Updates)
+		after.Updates[0].AfterTx = func(context.Context, squibble.DBConn) error { calls++; return nil }
+
+		db := mustOpenDB(t)
+		if err := (&squibble.Schema{Current: v1, Logf: t.Logf}).Apply(t.Context(), db); err != nil {
+			t.Fatalf("Apply v1: unexpected error: %v", err)
+		}
+		if err := after.ApplyTo(t.Context(), db, mustHash(t, v2)); err != nil {
+			t.Fatalf("ApplyTo v2: unexpected error: %v", err)
+		}
+		if calls != 1 {
+			t.Errorf("After ApplyTo: AfterTx called %d times, want 1", calls)
+		}
+
+		// The step is not pending, so Apply does not run it again.
+		if err := after.Apply(t.Context(), db); err != nil {
+			t.Fatalf("Apply v3: unexpected error: %v", err)
+		}
+		if calls != 1 {
+			t.Errorf("After Apply: AfterTx called %d times, want 1", calls)
+		}
+	})
+}
+
+func TestSchemaAhead(t *testing.T) {
+	const v1 = `create table foo (x text)`
+	const v2 = `create table foo (x text, y text); create index fooy on foo (y)`
+	const v3 = `create table foo (y text)`
+
+	newer := &squibble.Schema{
+		Current: v2,
+		Updates: []squibble.UpdateRule{{
+			Source: mustHash(t, v1),
+			Target: mustHash(t, v2),
+			Apply:  squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`, `create index fooy on foo (y)`),
+		}},
+		Logf: t.Logf,
+	}
+	older := &squibble.Schema{Current: v1, Logf: t.Logf}
+
+	db := mustOpenDB(t)
+	if err := older.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v1: unexpected error: %v", err)
+	}
+	if err := newer.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v2: unexpected error: %v", err)
+	}
+
+	t.Run("Error", func(t *testing.T) {
+		err := older.Apply(t.Context(), db)
+		if !errors.Is(err, squibble.ErrSchemaAhead) {
+			t.Fatalf("Apply v1: got %v, want %v", err, squibble.ErrSchemaAhead)
+		}
+		var ae squibble.SchemaAheadError
+		if !errors.As(err, &ae) {
+			t.Fatalf("Apply v1: got %T, want SchemaAheadError", err)
+		}
+		if ae.Current != mustHash(t, v1) {
+			t.Errorf("Current: got %s, want %s", ae.Current, mustHash(t, v1))
+		}
+		if want := []string{mustHash(t, v2)}; !slices.Equal(ae.Digests, want) {
+			t.Errorf("Digests: got %q, want %q", ae.Digests, want)
+		}
+		if ae.Schema != v2 {
+			t.Errorf("Schema: got %q, want %q", ae.Schema, v2)
+		}
+		if len(ae.Diff.Added) != 1 || len(ae.Diff.Modified) != 1 || len(ae.Diff.Removed) != 0 {
+			t.Errorf("Diff: got %+v, want one added and one modified", ae.Diff)
+		}
+	})
+
+	t.Run("Additive", func(t *testing.T) {
+		older.AllowAdditive = true
+		defer func() { older.AllowAdditive = false }()
+
+		if err := older.Apply(t.Context(), db); err != nil {
+			t.Fatalf("Apply v1: unexpected error: %v", err)
+		}
+		p, err := older.Plan(t.Context(), db)
+		if err != nil {
+			t.Fatalf("Plan: unexpected error: %v", err)
+		} else if p.Kind != squibble.PlanAhead {
+			t.Errorf("Plan: got %v, want %v", p.Kind, squibble.PlanAhead)
+		}
+	})
+
+	t.Run("NotAdditive", func(t *testing.T) {
+		newer.Current = v3
+		newer.Updates = append(newer.Updates, squibble.UpdateRule{
+			Source: mustHash(t, v2),
+			Target: mustHash(t, v3),
+			Apply:  squibble.Exec(`DROP INDEX fooy`, `ALTER TABLE foo DROP COLUMN x`),
+		})
+		if err := newer.Apply(t.Context(), db); err != nil {
+			t.Fatalf("Apply v3: unexpected error: %v", err)
+		}
+
+		older.AllowAdditive = true
+		defer func() { older.AllowAdditive = false }()
+
+		err := older.Apply(t.Context(), db)
+		var ae squibble.SchemaAheadError
+		if !errors.As(err, &ae) {
+			t.Fatalf("Apply v1: got %v, want SchemaAheadError", err)
+		}
+		if want := []string{mustHash(t, v2), mustHash(t, v3)}; !slices.Equal(ae.Digests, want) {
+			t.Errorf("Digests: got %q, want %q", ae.Digests, want)
+		}
+	})
+}
+
+func TestErrors(t *testing.T) {
+	const v1 = `create table foo (x text)`
+	const v2 = `create table foo (x text, y text)`
+	const v3 = `create table foo (x text, y text, z text)`
+
+	db := mustOpenDB(t)
+	if err := (&squibble.Schema{Current: v1, Logf: t.Logf}).Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v1: unexpected error: %v", err)
+	}
+	errBoom := errors.New("boom")
+
+	t.Run("MissingRule", func(t *testing.T) {
+		s := &squibble.Schema{Current: v2, Logf: t.Logf}
+		var me squibble.MissingRuleError
+		if err := s.Apply(t.Context(), db); !errors.As(err, &me) {
+			t.Fatalf("Apply: got %v, want MissingRuleError", err)
+		} else if !errors.Is(err, squibble.ErrMissingRule) {
+			t.Errorf("Apply: got %v, want %v", err, squibble.ErrMissingRule)
+		}
+		if me.Digest != mustHash(t, v1) {
+			t.Errorf("Digest: got %s, want %s", me.Digest, mustHash(t, v1))
+		}
+	})
+
+	t.Run("RuleFailed", func(t *testing.T) {
+		s := &squibble.Schema{
+			Current: v3,
+			Updates: []squibble.UpdateRule{{
+				Source: mustHash(t, v1),
+				Target: mustHash(t, v2),
+				Apply:  squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`),
+			}, {
+				Source: mustHash(t, v2),
+				Target: mustHash(t, v3),
+				Apply:  func(context.Context, squibble.DBConn) error { return errBoom },
+			}},
+			Logf: t.Logf,
+		}
+		err := s.Apply(t.Context(), db)
+		var re squibble.RuleFailedError
+		if !errors.As(err, &re) {
+			t.Fatalf("Apply: got %v, want RuleFailedError", err)
+		}
+		if !errors.Is(err, squibble.ErrRuleFailed) || !errors.Is(err, errBoom) {
+			t.Errorf("Apply: got %v, want %v wrapping %v", err, squibble.ErrRuleFailed, errBoom)
+		}
+		if re.Rule != 2 || re.Source != mustHash(t, v2) || re.Target != mustHash(t, v3) {
+			t.Errorf("RuleFailedError: got %+v, want rule 2 from v2 to v3", re)
+		}
+	})
+
+	t.Run("TargetMismatch", func(t *testing.T) {
+		s := &squibble.Schema{
+			Current: v2,
+			Updates: []squibble.UpdateRule{{
+				Source: mustHash(t, v1),
+				Target: mustHash(t, v2),
+				Apply:  squibble.Exec(`ALTER TABLE foo ADD COLUMN z text`),
+			}},
+			Logf: t.Logf,
+		}
+		err := s.Apply(t.Context(), db)
+		var te squibble.TargetMismatchError
+		if !errors.As(err, &te) {
+			t.Fatalf("Apply: got %v, want TargetMismatchError", err)
+		} else if !errors.Is(err, squibble.ErrTargetMismatch) {
+			t.Errorf("Apply: got %v, want %v", err, squibble.ErrTargetMismatch)
+		}
+		if te.Rule != 1 || te.Target != mustHash(t, v2) || te.Got == te.Target {
+			t.Errorf("TargetMismatchError: got %+v, want rule 1 missing v2", te)
+		}
+		if te.Diff == "" || te.Changes.IsEmpty() {
+			t.Error("TargetMismatchError: missing diff")
+		}
+		if !strings.Contains(te.Schema, "z text") {
+			t.Errorf("TargetMismatchError: schema %q does not show column z", te.Schema)
+		}
+		t.Logf("Error: %v", err)
+	})
+
+	t.Run("TargetMismatchUnknown", func(t *testing.T) {
+		// The text of v2 is not known, so there is no diff, only the schema.
+		s := &squibble.Schema{
+			Current: v3,
+			Updates: []squibble.UpdateRule{{
+				Source: mustHash(t, v1),
+				Target: mustHash(t, v2),
+				Apply:  squibble.Exec(`ALTER TABLE foo ADD COLUMN z text`),
+			}, {
+				Source: mustHash(t, v2),
+				Target: mustHash(t, v3),
+				Apply:  squibble.Exec(`ALTER TABLE foo ADD COLUMN z text`),
+			}},
+			Logf: t.Logf,
+		}
+		err := s.Apply(t.Context(), db)
+		var te squibble.TargetMismatchError
+		if !errors.As(err, &te) {
+			t.Fatalf("Apply: got %v, want TargetMismatchError", err)
+		}
+		if te.Diff != "" || te.Changes != nil {
+			t.Errorf("TargetMismatchError: got diff %q, want none", te.Diff)
+		}
+		if !strings.Contains(err.Error(), te.Schema) || !strings.Contains(te.Schema, "z text") {
+			t.Errorf("TargetMismatchError: got %v, want schema with column z", err)
+		}
+	})
+
+	t.Run("InconsistentChain", func(t *testing.T) {
+		s := &squibble.Schema{
+			Current: v3,
+			Updates: []squibble.UpdateRule{{
+				Source: mustHash(t, v1),
+				Target: mustHash(t, v2),
+				Apply:  squibble.NoAction,
+			}},
+		}
+		err := s.Check()
+		var ce squibble.InconsistentChainError
+		if !errors.As(err, &ce) {
+			t.Fatalf("Check: got %v, want InconsistentChainError", err)
+		} else if !errors.Is(err, squibble.ErrInconsistentChain) {
+			t.Errorf("Check: got %v, want %v", err, squibble.ErrInconsistentChain)
+		}
+		if ce.Rule != 0 || ce.Want != mustHash(t, v3) || ce.Got != mustHash(t, v2) {
+			t.Errorf("InconsistentChainError: got %+v, want missing v2 to v3", ce)
+		}
+	})
+}
+
+func TestTargetSQL(t *testing.T) {
+	const v1 = `create table foo (x text)`
+	const v2 = `create table foo (x text, y text)`
+	const v3 = `create table foo (x text, y text, z text)`
+
+	t.Run("Check", func(t *testing.T) {
+		s := &squibble.Schema{
+			Current: v2,
+			Updates: []squibble.UpdateRule{{
+				Source:    mustHash(t, v1),
+				Target:    mustHash(t, v2),
+				TargetSQL: v3,
+				Apply:     squibble.NoAction,
+			}},
+		}
+		if err := s.Check(); err == nil || !strings.Contains(err.Error(), "target SQL has digest") {
+			t.Errorf("Check: got %v, want target SQL mismatch", err)
+		}
+		s.Updates[0].TargetSQL = v2
+		if err := s.Check(); err != nil {
+			t.Errorf("Check: unexpected error: %v", err)
+		}
+	})
+
+	db := mustOpenDB(t)
+	if err := (&squibble.Schema{Current: v1, Logf: t.Logf}).Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v1: unexpected error: %v", err)
+	}
+	s := &squibble.Schema{
+		Current: v3,
+		Updates: []squibble.UpdateRule{{
+			Source:    mustHash(t, v1),
+			Target:    mustHash(t, v2),
+			TargetSQL: v2,
+			Apply:     squibble.Exec(`ALTER TABLE foo ADD COLUMN z text`),
+		}, {
+			Source: mustHash(t, v2),
+			Target: mustHash(t, v3),
+			Apply:  squibble.Exec(`ALTER TABLE foo ADD COLUMN z text`),
+		}},
+		CommitEachRule: true,
+		Logf:           t.Logf,
+	}
+
+	t.Run("Mismatch", func(t *testing.T) {
+		err := s.Apply(t.Context(), db)
+		var te squibble.TargetMismatchError
+		if !errors.As(err, &te) {
+			t.Fatalf("Apply: got %v, want TargetMismatchError", err)
+		} else if te.Diff == "" {
+			t.Errorf("TargetMismatchError: missing diff: %v", err)
+		}
+	})
+
+	t.Run("History", func(t *testing.T) {
+		s.Updates[0].Apply = squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`)
+		if err := s.Apply(t.Context(), db); err != nil {
+			t.Fatalf("Apply: unexpected error: %v", err)
+		}
+		hr, err := squibble.History(t.Context(), db)
+		if err != nil {
+			t.Fatalf("History: unexpected error: %v", err)
+		}
+		var got []string
+		for _, h := range hr {
+			got = append(got, h.Schema)
+		}
+		if want := []string{v1, v2, v3}; !slices.Equal(got, want) {
+			t.Errorf("History schemas: got %q, want %q", got, want)
+		}
+	})
+}
+
+func TestHooks(t *testing.T) {
+	const v1 = `create table foo (x text)`
+	const v2 = `create table foo (x text, y text)`
+	const v3 = `create table foo (x text, y text, z text)`
+
+	db := mustOpenDB(t)
+	if err := (&squibble.Schema{Current: v1, Logf: t.Logf}).Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v1: unexpected error: %v", err)
+	}
+
+	var events []string
+	errStop := errors.New("stop")
+	var stopAt int
+	s := &squibble.Schema{
+		Current: v3,
+		Updates: []squibble.UpdateRule{{
+			Source: mustHash(t, v1),
+			Target: mustHash(t, v2),
+			Apply:  squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`),
+			Revert: squibble.Exec(`ALTER TABLE foo DROP COLUMN y`),
+		}, {
+			Source: mustHash(t, v2),
+			Target: mustHash(t, v3),
+			Apply:  squibble.Exec(`ALTER TABLE foo ADD COLUMN z text`),
+			Revert: squibble.Exec(`ALTER TABLE foo DROP COLUMN z`),
+		}},
+		Logf: t.Logf,
+
+		BeforeApply: func(context.Context) error {
+			events = append(events, "begin")
+			return nil
+		},
+		BeforeRule: func(_ context.Context, info squibble.RuleInfo) error {
+			if info.Tx == nil {
+				t.Error("BeforeRule: missing transaction")
+			}
+			events = append(events, fmt.Sprintf("before %d %v", info.Index, info.Revert))
+			if info.Index == stopAt {
+				return errStop
+			}
+			return nil
+		},
+		AfterRule: func(_ context.Context, info squibble.RuleInfo) error {
+			events = append(events, fmt.Sprintf("after %d %v", info.Index, info.Revert))
+			return nil
+		},
+		AfterCommit: func(_ context.Context, p *squibble.Plan, err error) {
+			events = append(events, fmt.Sprintf("end %v %v", p.Kind, err))
+		},
+	}
+	check := func(t *testing.T, want ...string) {
+		t.Helper()
+		if !slices.Equal(events, want) {
+			t.Errorf("Events: got %q, want %q", events, want)
+		}
+		events = nil
+	}
+
+	t.Run("Fail", func(t *testing.T) {
+		stopAt = 2
+		defer func() { stopAt = 0 }()
+		if err := s.Apply(t.Context(), db); !errors.Is(err, errStop) {
+			t.Errorf("Apply: got %v, want %v", err, errStop)
+		}
+		check(t, "begin", "before 1 false", "after 1 false", "before 2 false", "end upgrade stop")
+	})
+	t.Run("Apply", func(t *testing.T) {
+		if err := s.Apply(t.Context(), db); err != nil {
+			t.Fatalf("Apply: unexpected error: %v", err)
+		}
+		check(t, "begin", "before 1 false", "after 1 false", "before 2 false", "after 2 false", "end upgrade <nil>")
+	})
+	t.Run("Revert", func(t *testing.T) {
+		if err := s.ApplyTo(t.Context(), db, mustHash(t, v1)); err != nil {
+			t.Fatalf("ApplyTo: unexpected error: %v", err)
+		}
+		check(t, "begin", "before 2 true", "after 2 true", "before 1 true", "after 1 true", "end revert <nil>")
+	})
+	t.Run("DryRun", func(t *testing.T) {
+		if _, err := s.DryRun(t.Context(), db); err != nil {
+			t.Fatalf("DryRun: unexpected error: %v", err)
+		}
+		check(t)
+	})
+}
+
+func TestLogger(t *testing.T) {
+	const v1 = `create table foo (x text)`
+	const v2 = `create table foo (x text, y text)`
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	db := mustOpenDB(t)
+	s := &squibble.Schema{Current: v1, Logger: logger}
+	if err := s.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v1: unexpected error: %v", err)
+	}
+	s.Current = v2
+	s.Updates = []squibble.UpdateRule{{
+		Source: mustHash(t, v1),
+		Target: mustHash(t, v2),
+		Apply: func(ctx context.Context, db squibble.DBConn) error {
+			squibble.Logf(ctx, "adding column %s", "y")
+			_, err := db.ExecContext(ctx, `ALTER TABLE foo ADD COLUMN y text`)
+			return err
+		},
+	}}
+	if err := s.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v2: unexpected error: %v", err)
+	}
+
+	type record struct {
+		Level   string
+		Msg     string
+		Rule    int
+		Source  string
+		Target  string
+		Elapsed int64
+		Error   string
+	}
+	readRecords := func(t *testing.T) []record {
+		t.Helper()
+		defer buf.Reset()
+		var recs []record
+		dec := json.NewDecoder(&buf)
+		for dec.More() {
+			var r record
+			if err := dec.Decode(&r); err != nil {
+				t.Fatalf("Decode log record: %v", err)
+			}
+			t.Logf("Log: %+v", r)
+			recs = append(recs, r)
+		}
+		return recs
+	}
+	recs := readRecords(t)
+	if !slices.ContainsFunc(recs, func(r record) bool { return r.Msg == "adding column y" }) {
+		t.Error("Missing log message from update rule")
+	}
+	i := slices.IndexFunc(recs, func(r record) bool { return r.Msg == "applied update" })
+	if i < 0 {
+		t.Fatal("Missing log record for applied update")
+	}
+	if r := recs[i]; r.Level != "INFO" || r.Rule != 1 || r.Source != mustHash(t, v1) ||
+		r.Target != mustHash(t, v2) || r.Elapsed <= 0 {
+		t.Errorf("Applied update: got %+v, want rule 1 from v1 to v2", r)
+	}
+
+	t.Run("Failure", func(t *testing.T) {
+		const v3 = `create table foo (x text, y text, z text)`
+		s.Current = v3
+		s.Updates = append(s.Updates, squibble.UpdateRule{
+			Source: mustHash(t, v2),
+			Target: mustHash(t, v3),
+			Apply:  squibble.Exec(`SELECT nonesuch FROM foo`),
+		})
+		if err := s.Apply(t.Context(), db); err == nil {
+			t.Fatal("Apply v3: got nil, want error")
+		}
+		recs := readRecords(t)
+		for _, msg := range []string{"update rule failed", "schema update failed"} {
+			i := slices.IndexFunc(recs, func(r record) bool { return r.Msg == msg })
+			if i < 0 {
+				t.Errorf("Missing log record %q", msg)
+			} else if r := recs[i]; r.Level != "ERROR" || r.Error == "" {
+				t.Errorf("Log record %q: got %+v, want level ERROR with error", msg, r)
+			}
+		}
+		if i := slices.IndexFunc(recs, func(r record) bool { return r.Msg == "update rule failed" }); i >= 0 {
+			if r := recs[i]; r.Rule != 2 || r.Source != mustHash(t, v2) || r.Target != mustHash(t, v3) {
+				t.Errorf("Rule failed: got %+v, want rule 2 from v2 to v3", r)
+			}
+		}
+	})
+}
+
+func TestLogf(t *testing.T) {
+	const v1 = `create table foo (x text)`
+	const v2 = `create table foo (x text, y text)`
+
+	var logs []string
+	db := mustOpenDB(t)
+	s := &squibble.Schema{
+		Current: v1,
+		Logf: func(msg string, args ...any) {
+			logs = append(logs, fmt.Sprintf(msg, args...))
+			t.Logf(msg, args...)
+		},
+	}
+	if err := s.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v1: unexpected error: %v", err)
+	}
+	s.Current = v2
+	s.Updates = []squibble.UpdateRule{{
+		Source: mustHash(t, v1),
+		Target: mustHash(t, v2),
+		Apply:  squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`),
+	}}
+	if err := s.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v2: unexpected error: %v", err)
+	}
+
+	// Logf receives the same messages it did before Logger was added.
+	for _, want := range []string{
+		"Checking schema version...",
+		"Initialized database with schema " + mustHash(t, v1),
+		"Database schema: " + mustHash(t, v1),
+		"Target schema:   " + mustHash(t, v2),
+		"Applying 1 pending schema upgrades",
+		"[1] updated to digest " + mustHash(t, v2),
+		"Schema successfully updated to digest " + mustHash(t, v2),
+	} {
+		if !slices.Contains(logs, want) {
+			t.Errorf("Missing log message %q", want)
+		}
+	}
+}
+
+type testMetrics struct {
+	events []string
+}
+
+func (m *testMetrics) ApplyDone(p *squibble.Plan, elapsed time.Duration, err error) {
+	m.events = append(m.events, fmt.Sprintf("apply %v %v %v", p.Kind, elapsed > 0, err))
+}
+
+func (m *testMetrics) RuleDone(info squibble.RuleInfo, elapsed time.Duration, err error) {
+	m.events = append(m.events, fmt.Sprintf("rule %d %v %v", info.Index, elapsed > 0, err != nil))
+}
+
+func TestMetrics(t *testing.T) {
+	const v1 = `create table foo (x text)`
+	const v2 = `create table foo (x text, y text)`
+	const v3 = `create table foo (x text, y text, z text)`
+
+	db := mustOpenDB(t)
+	if err := (&squibble.Schema{Current: v1, Logf: t.Logf}).Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v1: unexpected error: %v", err)
+	}
+
+	m := new(testMetrics)
+	s := &squibble.Schema{
+		Current: v3,
+		Updates: []squibble.UpdateRule{{
+			Source: mustHash(t, v1),
+			Target: mustHash(t, v2),
+			Apply:  squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`),
+		}, {
+			Source: mustHash(t, v2),
+			Target: mustHash(t, v3),
+			Apply:  squibble.Exec(`ALTER TABLE foo ADD COLUMN z integer`), // wrong
+		}},
+		Logf:    t.Logf,
+		Metrics: m,
+	}
+	check := func(t *testing.T, want ...string) {
+		t.Helper()
+		if !slices.Equal(m.events, want) {
+			t.Errorf("Events: got %q, want %q", m.events, want)
+		}
+		m.events = nil
+	}
+
+	err := s.Apply(t.Context(), db)
+	if !errors.Is(err, squibble.ErrTargetMismatch) {
+		t.Errorf("Apply: got %v, want %v", err, squibble.ErrTargetMismatch)
+	}
+	check(t, "rule 1 true false", "rule 2 true true", fmt.Sprintf("apply upgrade true %v", err))
+
+	s.Updates[1].Apply = squibble.Exec(`ALTER TABLE foo ADD COLUMN z text`)
+	if err := s.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply: unexpected error: %v", err)
+	}
+	check(t, "rule 1 true false", "rule 2 true false", "apply upgrade true <nil>")
+
+	hr, err := squibble.History(t.Context(), db)
+	if err != nil {
+		t.Fatalf("History: unexpected error: %v", err)
+	} else if len(hr) != 2 {
+		t.Fatalf("History: got %d rows, want 2", len(hr))
+	}
+	if hr[0].Rules != nil {
+		t.Errorf("History[0] rules: got %v, want none", hr[0].Rules)
+	}
+	if last := hr[1]; last.Digest != mustHash(t, v3) || last.Elapsed <= 0 || !slices.Equal(last.Rules, []int{1, 2}) {
+		t.Errorf("History[1]: got digest %s, elapsed %v, rules %v; want v3, rules [1 2]",
+			last.Digest, last.Elapsed, last.Rules)
+	}
+}
+
+func TestHistoryTable(t *testing.T) {
+	const a1 = `create table alpha (x text)`
+	const a2 = `create table alpha (x text, y text)`
+	const b1 = `create table "beta" (z integer)`
+
+	db := mustOpenDB(t)
+
+	// Two independently-versioned schemas share the database, each ignoring
+	// the tables of the other.
+	sa := &squibble.Schema{
+		Current:      a1,
+		HistoryTable: "alpha_history",
+		IgnoreTables: []string{"beta", "beta history"},
+		Logf:         t.Logf,
+	}
+	sb := &squibble.Schema{
+		Current:      b1,
+		HistoryTable: "beta history",
+		IgnoreTables: []string{"alpha", "alpha_history"},
+		Logf:         t.Logf,
+	}
+	if err := sa.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply alpha: unexpected error: %v", err)
+	}
+	if err := sb.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply beta: unexpected error: %v", err)
+	}
+
+	sa.Current = a2
+	sa.Updates = []squibble.UpdateRule{{
+		Source: mustHash(t, a1),
+		Target: mustHash(t, a2),
+		Apply:  squibble.Exec(`ALTER TABLE alpha ADD COLUMN y text`),
+	}}
+	if err := sa.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply alpha v2: unexpected error: %v", err)
+	}
+	if err := sb.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply beta again: unexpected error: %v", err)
+	}
+
+	checkHistory := func(table string, want ...string) {
+		t.Helper()
+		hr, err := squibble.ReadHistory(t.Context(), db, &squibble.DigestOptions{HistoryTable: table})
+		if err != nil {
+			t.Fatalf("ReadHistory %q: unexpected error: %v", table, err)
+		}
+		var got []string
+		for _, h := range hr {
+			got = append(got, h.Digest)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("ReadHistory %q: got %q, want %q", table, got, want)
+		}
+	}
+	checkHistory("alpha_history", mustHash(t, a1), mustHash(t, a2))
+	checkHistory("beta history", mustHash(t, b1))
+
+	// The default history table was not created.
+	if _, err := squibble.History(t.Context(), db); err == nil {
+		t.Error("History: got nil error for missing default table")
+	}
+}
+
+func TestTablePrefix(t *testing.T) {
+	const p1v1 = `create table p1_items (x text); create index p1_items_x on p1_items (x)`
+	const p1v2 = `create table p1_items (x text, y text); create index p1_items_x on p1_items (x)`
+	const p2v1 = `create table p2_log (msg text); create view p2_recent as select * from p2_log`
+
+	db := mustOpenDB(t)
+	if _, err := db.Exec(`create table unrelated (z blob)`); err != nil {
+		t.Fatalf("Create unrelated table: %v", err)
+	}
+
+	s1 := &squibble.Schema{Current: p1v1, TablePrefix: "p1_", Logf: t.Logf}
+	s2 := &squibble.Schema{Current: p2v1, TablePrefix: "p2_", Logf: t.Logf}
+	if err := s1.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply p1: unexpected error: %v", err)
+	}
+	if err := s2.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply p2: unexpected error: %v", err)
+	}
+
+	// Each schema's digest covers only the objects it owns.
+	if got, err := squibble.DBDigest(t.Context(), db, &squibble.DigestOptions{TablePrefix: "p2_"}); err != nil {
+		t.Fatalf("DBDigest p2: unexpected error: %v", err)
+	} else if want := mustHash(t, p2v1); got != want {
+		t.Errorf("DBDigest p2: got %s, want %s", got, want)
+	}
+
+	s1.Current = p1v2
+	s1.Updates = []squibble.UpdateRule{{
+		Source: mustHash(t, p1v1),
+		Target: mustHash(t, p1v2),
+		Apply:  squibble.Exec(`ALTER TABLE p1_items ADD COLUMN y text`),
+	}}
+	if err := s1.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply p1 v2: unexpected error: %v", err)
+	}
+	if err := s2.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply p2 again: unexpected error: %v", err)
+	}
+
+	// Each schema has its own history table, named by its prefix.
+	for _, tc := range []struct {
+		prefix string
+		want   []string
+	}{
+		{"p1_", []string{mustHash(t, p1v1), mustHash(t, p1v2)}},
+		{"p2_", []string{mustHash(t, p2v1)}},
+	} {
+		hr, err := squibble.ReadHistory(t.Context(), db, &squibble.DigestOptions{TablePrefix: tc.prefix})
+		if err != nil {
+			t.Fatalf("ReadHistory %q: unexpected error: %v", tc.prefix, err)
+		}
+		var got []string
+		for _, h := range hr {
+			got = append(got, h.Digest)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("ReadHistory %q: got %q, want %q", tc.prefix, got, tc.want)
+		}
+	}
+
+	t.Run("Check", func(t *testing.T) {
+		bad := &squibble.Schema{Current: `create table p3_a (x); create table b (y)`, TablePrefix: "p3_"}
+		if err := bad.Check(); err == nil || !strings.Contains(err.Error(), `table "b" does not have prefix`) {
+			t.Errorf("Check: got %v, want prefix error", err)
+		}
+	})
+}
+
+func TestAttachedDatabase(t *testing.T) {
+	const v1 = `create table foo (x text); create index foo_x on foo (x);
+create view bar as select x from foo`
+	const v2 = `create table foo (x text, y text); create index foo_x on foo (x);
+create view bar as select x from foo`
+
+	// Database attachments are per connection, so use only one.
+	db := mustOpenDB(t)
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(`ATTACH ? AS cold`, filepath.Join(t.TempDir(), "cold.db")); err != nil {
+		t.Fatalf("Attach database: %v", err)
+	}
+
+	s := &squibble.Schema{Current: v1, Database: "cold", Logf: t.Logf}
+	if err := s.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v1: unexpected error: %v", err)
+	}
+	s.Current = v2
+	s.Updates = []squibble.UpdateRule{{
+		Source: mustHash(t, v1),
+		Target: mustHash(t, v2),
+		Apply:  squibble.Exec(`ALTER TABLE cold.foo ADD COLUMN y text`),
+	}}
+	if err := s.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply v2: unexpected error: %v", err)
+	}
+
+	tx, err := db.BeginTx(t.Context(), nil)
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	defer tx.Rollback()
+
+	opts := &squibble.DigestOptions{Database: "cold"}
+	if err := squibble.Validate(t.Context(), tx, v2, opts); err != nil {
+		t.Errorf("Validate cold: unexpected error: %v", err)
+	}
+	if got, err := squibble.DBDigest(t.Context(), tx, nil); err != nil {
+		t.Errorf("DBDigest main: unexpected error: %v", err)
+	} else if want := mustHash(t, ""); got != want {
+		t.Errorf("DBDigest main: got %s, want empty schema %s", got, want)
+	}
+	if hr, err := squibble.ReadHistory(t.Context(), tx, opts); err != nil {
+		t.Fatalf("ReadHistory: unexpected error: %v", err)
+	} else if len(hr) != 2 || hr[1].Digest != mustHash(t, v2) {
+		t.Errorf("ReadHistory: got %+v, want 2 rows ending at v2", hr)
+	}
+	tx.Rollback()
+
+	t.Run("RebuildTable", func(t *testing.T) {
+		const v3 = `create table foo (x text not null, y text); create index foo_x on foo (x);
+create view bar as select x from foo`
+		s.Current = v3
+		s.Updates = append(s.Updates, squibble.UpdateRule{
+			Source: mustHash(t, v2),
+			Target: mustHash(t, v3),
+			Apply:  squibble.RebuildTable("foo", `create table foo (x text not null, y text)`, nil),
+		})
+		if err := s.Apply(t.Context(), db); err != nil {
+			t.Fatalf("Apply v3: unexpected error: %v", err)
+		}
+		tx, err := db.BeginTx(t.Context(), nil)
+		if err != nil {
+			t.Fatalf("Begin: %v", err)
+		}
+		defer tx.Rollback()
+		if err := squibble.Validate(t.Context(), tx, v3, opts); err != nil {
+			t.Errorf("Validate cold: unexpected error: %v", err)
+		}
+		if got, err := squibble.DBDigest(t.Context(), tx, nil); err != nil {
+			t.Errorf("DBDigest main: unexpected error: %v", err)
+		} else if want := mustHash(t, ""); got != want {
+			t.Errorf("DBDigest main: got %s, want empty schema %s", got, want)
+		}
+	})
+
+	t.Run("ForeignKeys", func(t *testing.T) {
+		if _, err := db.Exec(`ATTACH ? AS fk`, filepath.Join(t.TempDir(), "fk.db")); err != nil {
+			t.Fatalf("Attach database: %v", err)
+		}
+		const v1 = `create table p (id integer primary key); create table c (p integer references p (id))`
+		const v2 = v1 + `; create table z (a text)`
+		s := &squibble.Schema{Current: v1, Database: "fk", DisableForeignKeys: true, Logf: t.Logf}
+		if err := s.Apply(t.Context(), db); err != nil {
+			t.Fatalf("Apply v1: unexpected error: %v", err)
+		}
+
+		// The check after the update must cover the attached database.
+		s.Current = v2
+		s.Updates = []squibble.UpdateRule{{
+			Source: mustHash(t, v1),
+			Target: mustHash(t, v2),
+			Apply:  squibble.Exec(`INSERT INTO fk.c (p) VALUES (5)`, `CREATE TABLE fk.z (a text)`),
+		}}
+		err := s.Apply(t.Context(), db)
+		var fke squibble.ForeignKeyError
+		if !errors.As(err, &fke) || len(fke.Violations) != 1 {
+			t.Fatalf("Apply v2: got %v, want 1 foreign key violation", err)
+		}
+		t.Logf("Apply v2: got expected error: %v", err)
+	})
+}
+
+func TestDigestV2(t *testing.T) {
+	const base = `create table p (id integer primary key); create table t (a text, p integer)`
+	t.Run("Variants", func(t *testing.T) {
+		// Each schema differs from the base only in properties that DigestV1
+		// does not record.
+		for _, tc := range []struct{ base, text string }{
+			{base, `create table p (id integer primary key); create table t (a text check (a != ''), p integer)`},
+			{base, `create table p (id integer primary key); create table t (a text collate nocase, p integer)`},
+			{base, `create table p (id integer primary key); create table t (a text unique, p integer)`},
+			{base, `create table p (id integer primary key); create table t (a text, p integer references p (id))`},
+			{base, `create table p (id integer primary key); create table t (a text, p integer) strict`},
+		} {
+			if got, want := mustHashVersion(t, tc.text, squibble.DigestV1), mustHashVersion(t, tc.base, squibble.DigestV1); got != want {
+				t.Errorf("V1 digest of %q: got %s, want %s", tc.text, got, want)
+			}
+			if got, base := mustHashVersion(t, tc.text, squibble.DigestV2), mustHashVersion(t, tc.base, squibble.DigestV2); got == base {
+				t.Errorf("V2 digest of %q: got %s, same as base", tc.text, got)
+			}
+		}
+	})
+	t.Run("Spelling", func(t *testing.T) {
+		const a = `CREATE TABLE t (x INTEGER CONSTRAINT pos CHECK(x>0), y TEXT COLLATE NoCase)`
+		const b = `create table t (
+  x integer,
+  y text collate "nocase",
+  check ( X > 0 )  -- the same constraint
+)`
+		if got, want := mustHashVersion(t, a, squibble.DigestV2), mustHashVersion(t, b, squibble.DigestV2); got != want {
+			t.Errorf("V2 digests differ:\n%s\n%s", a, b)
+		}
+	})
+	t.Run("Conflict", func(t *testing.T) {
+		// A column constraint is equivalent to the table constraint, with
+		// the same conflict clause, but not with a different one.
+		const (
+			col     = `create table t (a text unique on conflict replace)`
+			table   = `create table t (a text, unique (a) on conflict replace)`
+			plain   = `create table t (a text unique)`
+			ignored = `create table t (a text unique on conflict ignore)`
+		)
+		if got, want := mustHashVersion(t, col, squibble.DigestV2), mustHashVersion(t, table, squibble.DigestV2); got != want {
+			t.Errorf("V2 digests differ:\n%s\n%s", col, table)
+		}
+		for _, other := range []string{plain, ignored} {
+			if got, base := mustHashVersion(t, other, squibble.DigestV2), mustHashVersion(t, col, squibble.DigestV2); got == base {
+				t.Errorf("V2 digest of %q: got %s, same as %q", other, got, col)
+			}
+		}
+	})
+
+	t.Run("Apply", func(t *testing.T) {
+		const v2 = `create table p (id integer primary key);
+create table t (a text check (a != ''), p integer references p (id))`
+
+		db := mustOpenDB(t)
+		s := &squibble.Schema{Current: base, DigestVersion: squibble.DigestV2, Logf: t.Logf}
+		if err := s.Apply(t.Context(), db); err != nil {
+			t.Fatalf("Apply base: unexpected error: %v", err)
+		}
+		s.Current = v2
+		s.Updates = []squibble.UpdateRule{{
+			Source: mustHashVersion(t, base, squibble.DigestV2),
+			Target: mustHashVersion(t, v2, squibble.DigestV2),
+			Apply:  squibble.RebuildTable("t", `create table t (a text, p integer)`, nil), // wrong
+		}}
+		err := s.Apply(t.Context(), db)
+		var tm squibble.TargetMismatchError
+		if !errors.As(err, &tm) {
+			t.Fatalf("Apply: got %v, want %T", err, tm)
+		}
+		t.Logf("Mismatch: %v", err)
+		if c := tm.Changes; c == nil || len(c.Modified) != 1 || len(c.Modified[0].AddedConstraints) != 2 {
+			t.Errorf("Changes: got %+v, want 2 added constraints", c)
+		}
+
+		s.Updates[0].Apply = squibble.RebuildTable("t",
+			`create table t (a text check (a != ''), p integer references p (id))`, nil)
+		if err := s.Apply(t.Context(), db); err != nil {
+			t.Fatalf("Apply v2: unexpected error: %v", err)
+		}
+		opts := &squibble.DigestOptions{Version: squibble.DigestV2}
+		if err := squibble.Validate(t.Context(), db, v2, opts); err != nil {
+			t.Errorf("Validate v2: unexpected error: %v", err)
+		}
+		if err := squibble.Validate(t.Context(), db, base, opts); err == nil {
+			t.Error("Validate base: got nil error, want diff")
+		} else {
+			t.Logf("Validate base: %v", err)
+		}
+	})
+
+	t.Run("BadVersion", func(t *testing.T) {
+		s := &squibble.Schema{Current: base, DigestVersion: 99}
+		if err := s.Check(); err == nil {
+			t.Error("Check: got nil error for unknown digest version")
+		}
+	})
+}
+
+func TestDigestTags(t *testing.T) {
+	const (
+		base  = `create table t (a text)`
+		mid   = `create table t (a text, b integer)`
+		final = `create table t (a text check (a != ''), b integer)`
+	)
+
+	v1, v2 := mustHashVersion(t, mid, squibble.DigestV1), mustHashVersion(t, mid, squibble.DigestV2)
+	if strings.Contains(v1, ":") {
+		t.Errorf("V1 digest %q: should not be tagged", v1)
+	}
+	if hex, ok := strings.CutPrefix(v2, "v2:"); !ok || hex != v1 {
+		t.Errorf("V2 digest: got %q, want v2:%s", v2, v1)
+	}
+	for _, tc := range []struct {
+		digest string
+		want   squibble.DigestVersion
+	}{
+		{v1, squibble.DigestV1}, {v2, squibble.DigestV2}, {"v1:" + v1, 0}, {"x2:" + v1, 0}, {"v:" + v1, 0},
+	} {
+		if got := squibble.DigestVersionOf(tc.digest); got != tc.want {
+			t.Errorf("DigestVersionOf(%q): got %v, want %v", tc.digest, got, tc.want)
+		}
+	}
+
+	// Create one database at the base schema, and another at the middle
+	// schema, using version 1 digests.
+	older, newer := mustOpenDB(t), mustOpenDB(t)
+	s := &squibble.Schema{Current: base, Logf: t.Logf}
+	for _, db := range []*sql.DB{older, newer} {
+		if err := s.Apply(t.Context(), db); err != nil {
+			t.Fatalf("Apply base: unexpected error: %v", err)
+		}
+	}
+	s.Current = mid
+	s.Updates = []squibble.UpdateRule{{
+		Source:    mustHashVersion(t, base, squibble.DigestV1),
+		Target:    v1,
+		TargetSQL: mid,
+		Apply:     squibble.Exec(`alter table t add column b integer`),
+	}}
+	if err := s.Apply(t.Context(), newer); err != nil {
+		t.Fatalf("Apply mid: unexpected error: %v", err)
+	}
+
+	// Switch to version 2, with a new rule whose source is tagged.
+	s.Current = final
+	s.DigestVersion = squibble.DigestV2
+	s.Updates = append(s.Updates, squibble.UpdateRule{
+		Source: v2,
+		Target: mustHashVersion(t, final, squibble.DigestV2),
+		Apply:  squibble.RebuildTable("t", final, nil),
+	})
+	if err := s.Check(); err != nil {
+		t.Fatalf("Check: unexpected error: %v", err)
+	}
+	for _, db := range []*sql.DB{older, newer} {
+		if err := s.Apply(t.Context(), db); err != nil {
+			t.Fatalf("Apply final: unexpected error: %v", err)
+		}
+		if err := squibble.Validate(t.Context(), db, final, &squibble.DigestOptions{Version: squibble.DigestV2}); err != nil {
+			t.Errorf("Validate final: unexpected error: %v", err)
+		}
+	}
+
+	t.Run("Translate", func(t *testing.T) {
+		n, unknown, err := s.TranslateHistory(t.Context(), newer)
+		if err != nil {
+			t.Fatalf("TranslateHistory: unexpected error: %v", err)
+		}
+		if n != 2 || unknown != 0 {
+			t.Errorf("TranslateHistory: got %d, %d; want 2, 0", n, unknown)
+		}
+		hr, err := squibble.History(t.Context(), newer)
+		if err != nil {
+			t.Fatalf("History: unexpected error: %v", err)
+		}
+		want := []string{mustHashVersion(t, base, squibble.DigestV2), v2, mustHashVersion(t, final, squibble.DigestV2)}
+		var got []string
+		for _, h := range hr {
+			got = append(got, h.Digest)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("History digests: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("CommitEachRule", func(t *testing.T) {
+		// The last rule has a version 1 target, so the final history row must
+		// record the version 2 digest of the current schema instead.
+		db := mustOpenDB(t)
+		if err := (&squibble.Schema{Current: base, Logf: t.Logf}).Apply(t.Context(), db); err != nil {
+			t.Fatalf("Apply base: unexpected error: %v", err)
+		}
+		each := &squibble.Schema{
+			Current:        mid,
+			Updates:        s.Updates[:1],
+			DigestVersion:  squibble.DigestV2,
+			CommitEachRule: true,
+			Logf:           t.Logf,
+		}
+		if err := each.Apply(t.Context(), db); err != nil {
+			t.Fatalf("Apply mid: unexpected error: %v", err)
+		}
+		hr, err := squibble.History(t.Context(), db)
+		if err != nil {
+			t.Fatalf("History: unexpected error: %v", err)
+		}
+		if got := hr[len(hr)-1].Digest; got != v2 {
+			t.Errorf("Last history digest: got %s, want %s", got, v2)
+		}
+		if err := each.Apply(t.Context(), db); err != nil {
+			t.Errorf("Apply mid again: unexpected error: %v", err)
+		}
+	})
+
+	t.Run("NoTargetSQL", func(t *testing.T) {
+		// Without the text of its target, the first rule cannot be compared
+		// with the source of the second, which has a different version.
+		bad := *s
+		bad.Updates = slices.Clone(s.Updates)
+		bad.Updates[0].TargetSQL = ""
+		err := bad.Check()
+		var ce squibble.InconsistentChainError
+		if !errors.As(err, &ce) {
+			t.Fatalf("Check: got %v, want InconsistentChainError", err)
+		} else if ce.Rule != 2 || ce.Want != v1 || ce.Got != v2 {
+			t.Errorf("Check: got %+v, want rule 2 from %s to %s", ce, v1, v2)
+		}
+		if !strings.Contains(err.Error(), "TargetSQL") {
+			t.Errorf("Check: got %v, want mention of TargetSQL", err)
+		}
+	})
+
+	t.Run("BadTag", func(t *testing.T) {
+		bad := *s
+		bad.Updates = slices.Clone(s.Updates)
+		bad.Updates[1].Source = "v9:" + v1
+		if err := bad.Check(); err == nil {
+			t.Error("Check: got nil error for unknown digest tag")
+		} else {
+			t.Logf("Check: %v", err)
+		}
+	})
+}
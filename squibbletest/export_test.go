@@ -0,0 +1,7 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package squibbletest
+
+// CheckSeed exposes checkSeed to the tests.
+var CheckSeed = checkSeed
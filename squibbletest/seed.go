@@ -0,0 +1,186 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package squibbletest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/tailscale/squibble"
+)
+
+// A Seed describes data loaded into a database at a historical schema
+// version, and checks that the data are preserved by the update rules.
+//
+// To check a seed, [CheckUpgradePaths] initializes an empty database with
+// the Schema, executes the Data statements, then applies the update rules one
+// at a time until the database reaches the current schema. It runs all the
+// Checks before the first update and after each. A check fails if it does not
+// pass once all the rules have been applied. The failure reports the update
+// rule after which the check stopped passing for good: The first rule after
+// which its query gave a wrong result, ignoring queries that report errors
+// because they are not valid for the version at that point.
+//
+// The rules before the last are applied with [squibble.Schema.ApplyTo], so
+// their BeforeTx and AfterTx functions are not called.
+type Seed struct {
+	// Schema is the SQL text of the schema version at which the data are
+	// loaded. Its digest must match a version of the schema.
+	Schema string
+
+	// Data are SQL statements to populate the database.
+	Data []string
+
+	// Checks are queries to evaluate against the upgraded database.
+	Checks []Check
+}
+
+// A Check is a query with an expected result.
+type Check struct {
+	// Query is the SQL text of the query.
+	Query string
+
+	// Want are the rows the query should return, in order. Values are
+	// compared by their string representation per [fmt.Sprint], so that the
+	// exact types need not match. NULL is represented by nil.
+	Want [][]any
+}
+
+// checkSeed implements the checks for a single seed, and returns a
+// description of each failed check.
+func checkSeed(t testing.TB, s *squibble.Schema, seed Seed) []string {
+	t.Helper()
+	ds, err := versionDigests(s, seed.Schema)
+	if err != nil {
+		t.Fatalf("Seed schema: %v", err)
+	} else if len(ds) == 0 {
+		d, _ := squibble.SQLDigestVersion(seed.Schema, s.DigestVersion)
+		t.Fatalf("Seed schema digest %s is not a version of the schema", d)
+	}
+	start := len(s.Updates) // the current schema
+	for i, u := range s.Updates {
+		if slices.Contains(ds, u.Source) {
+			start = i
+			break
+		}
+	}
+
+	db := openDB(t)
+	initSchema(t, db, s, seed.Schema)
+	for i, stmt := range seed.Data {
+		if _, err := db.ExecContext(t.Context(), stmt); err != nil {
+			t.Fatalf("Seed data %d: %v", i+1, err)
+		}
+	}
+
+	// Record the outcome of each check before any update, and after each.
+	// A nil error means the check passed.
+	results := make([][]error, len(seed.Checks))
+	runChecks := func() {
+		for i, c := range seed.Checks {
+			results[i] = append(results[i], runCheck(t.Context(), db, c))
+		}
+	}
+	runChecks()
+	cp := *s
+	cp.Logf = t.Logf
+	for i := start; i < len(s.Updates); i++ {
+		if err := cp.ApplyTo(t.Context(), db, s.Updates[i].Target); err != nil {
+			t.Fatalf("Apply update %d: %v", i+1, err)
+		}
+		runChecks()
+	}
+
+	var fails []string
+	for i, res := range results {
+		last := res[len(res)-1]
+		if last == nil {
+			continue
+		}
+
+		// Find where the check began failing for good: The first wrong result
+		// after it last passed, or failing that, the first error. A query
+		// that reports an error may simply not be valid at that version.
+		p := len(res) - 1
+		for p > 0 && res[p-1] != nil {
+			p--
+		}
+		j := p
+		for k := p; k < len(res); k++ {
+			if errors.Is(res[k], errWrongResult) {
+				j = k
+				break
+			}
+		}
+		if j == 0 {
+			fails = append(fails, fmt.Sprintf("check %d fails before any update: %v", i+1, last))
+		} else {
+			u := s.Updates[start+j-1]
+			fails = append(fails, fmt.Sprintf("check %d fails after update %d (%s to %s): %v",
+				i+1, start+j, u.Source, u.Target, last))
+		}
+	}
+	return fails
+}
+
+var errWrongResult = errors.New("wrong result")
+
+// runCheck reports an error if the query of c fails or returns the wrong
+// result when run against db.
+func runCheck(ctx context.Context, db *sql.DB, c Check) error {
+	rows, err := db.QueryContext(ctx, c.Query)
+	if err != nil {
+		return fmt.Errorf("query %q: %w", c.Query, err)
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	var got [][]any
+	for rows.Next() {
+		row := make([]any, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range row {
+			ptrs[i] = &row[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return fmt.Errorf("query %q: %w", c.Query, err)
+		}
+		for i, v := range row {
+			if b, ok := v.([]byte); ok {
+				row[i] = string(b)
+			}
+		}
+		got = append(got, row)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("query %q: %w", c.Query, err)
+	}
+	if !equalRows(got, c.Want) {
+		return fmt.Errorf("query %q: %w: got %v, want %v", c.Query, errWrongResult, got, c.Want)
+	}
+	return nil
+}
+
+func equalRows(got, want [][]any) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if len(got[i]) != len(want[i]) {
+			return false
+		}
+		for j := range got[i] {
+			if fmt.Sprint(got[i][j]) != fmt.Sprint(want[i][j]) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package squibbletest_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/tailscale/squibble"
+	"github.com/tailscale/squibble/squibbletest"
+)
+
+func TestCheckSeed(t *testing.T) {
+	const v1 = `create table foo (x text)`
+	const v2 = `create table foo (x text, y text)`
+	const v3 = `create table foo (y text)`
+
+	s := &squibble.Schema{
+		Current: v3,
+		Updates: []squibble.UpdateRule{{
+			Source: mustHash(t, v1),
+			Target: mustHash(t, v2),
+			Apply:  squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`, `UPDATE foo SET y = x`),
+		}, {
+			Source: mustHash(t, v2),
+			Target: mustHash(t, v3),
+			Apply:  squibble.Exec(`ALTER TABLE foo DROP COLUMN x`),
+		}},
+	}
+	seed := squibbletest.Seed{
+		Schema: v1,
+		Data:   []string{`INSERT INTO foo (x) VALUES ('a'), ('b')`},
+		Checks: []squibbletest.Check{
+			{Query: `SELECT y FROM foo ORDER BY y`, Want: [][]any{{"a"}, {"b"}}},
+			{Query: `SELECT count(*) FROM foo`, Want: [][]any{{2}}},
+		},
+	}
+
+	t.Run("OK", func(t *testing.T) {
+		if fails := squibbletest.CheckSeed(t, s, seed); len(fails) != 0 {
+			t.Errorf("CheckSeed: unexpected failures: %q", fails)
+		}
+	})
+
+	t.Run("Broken", func(t *testing.T) {
+		// Break the first rule so that it loses the data in x.
+		bad := *s
+		bad.Updates = append([]squibble.UpdateRule(nil), s.Updates...)
+		bad.Updates[0].Apply = squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`)
+
+		fails := squibbletest.CheckSeed(t, &bad, seed)
+		if len(fails) != 1 || !strings.Contains(fails[0], "check 1 fails after update 1 ") {
+			t.Errorf("CheckSeed: got %q, want check 1 failing after update 1", fails)
+		}
+	})
+
+	t.Run("BrokenLater", func(t *testing.T) {
+		// Break the second rule so that it loses a row. The first rule is
+		// fine, so the failures should blame the second.
+		bad := *s
+		bad.Updates = append([]squibble.UpdateRule(nil), s.Updates...)
+		bad.Updates[1].Apply = squibble.Exec(`DELETE FROM foo WHERE x = 'b'`, `ALTER TABLE foo DROP COLUMN x`)
+
+		fails := squibbletest.CheckSeed(t, &bad, seed)
+		want := fmt.Sprintf("after update 2 (%s to %s)", mustHash(t, v2), mustHash(t, v3))
+		if len(fails) != 2 {
+			t.Fatalf("CheckSeed: got %q, want 2 failures", fails)
+		}
+		for i, f := range fails {
+			if !strings.HasPrefix(f, fmt.Sprintf("check %d fails ", i+1)) || !strings.Contains(f, want) {
+				t.Errorf("CheckSeed: got %q, want check %d failing %s", f, i+1, want)
+			}
+		}
+	})
+}
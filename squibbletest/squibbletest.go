@@ -0,0 +1,249 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package squibbletest provides support for testing the update rules of a
+// [squibble.Schema].
+//
+// The helpers in this package open in-memory SQLite databases using the
+// "sqlite" driver, which the calling test must register, for example by
+// importing modernc.org/sqlite.
+package squibbletest
+
+import (
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tailscale/squibble"
+)
+
+// Fixtures provides additional inputs to [CheckUpgradePaths].
+type Fixtures struct {
+	// Schemas are the SQL texts of historical schema versions, each matched
+	// to a version in the update sequence by its digest. These are needed
+	// only for versions whose text is not given by the TargetSQL of an update
+	// rule. See also [ReadSchemas].
+	Schemas []string
+
+	// Seeds are data to be loaded at historical schema versions, with checks
+	// that the data survive upgrading to the current schema.
+	Seeds []Seed
+}
+
+// ReadSchemas reads the contents of the files in fsys matching the specified
+// glob pattern, for use as the Schemas of a [Fixtures] value.
+func ReadSchemas(fsys fs.FS, pattern string) ([]string, error) {
+	names, err := fs.Glob(fsys, pattern)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, name := range names {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, string(data))
+	}
+	return out, nil
+}
+
+// CheckUpgradePaths checks that s can upgrade a database from each historical
+// schema version whose SQL text is known, to the current schema. The text of
+// a version is known if it is the TargetSQL of an update rule, or if it is
+// one of the Schemas of fixtures. A nil fixtures is valid and provides no
+// additional inputs.
+//
+// For each version with known text, CheckUpgradePaths runs a subtest that
+// initializes an empty in-memory database with that version, then applies s
+// to it. The subtest fails if any update rule fails or does not reach its
+// Target, or if the final schema does not validate against the current
+// schema. Versions whose text is not known are logged and skipped.
+//
+// In addition, CheckUpgradePaths runs a subtest for each of the Seeds of
+// fixtures, as described by [Seed].
+//
+// If t is not a [*testing.T] or [*testing.B], it does not support subtests, so
+// CheckUpgradePaths runs the checks directly on t, and stops at the first
+// fatal failure. CheckUpgradePaths does not support a Schema with a Database
+// other than "main", and fails if s has one.
+func CheckUpgradePaths(t testing.TB, s *squibble.Schema, fixtures *Fixtures) {
+	t.Helper()
+	if s.Database != "" && s.Database != "main" {
+		t.Fatalf("Schema database %q is not supported; the databases used for checks have only main", s.Database)
+	}
+	if err := s.Check(); err != nil {
+		t.Fatalf("Check schema: %v", err)
+	}
+	texts, err := schemaTexts(s, fixtures)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check each historical version, then the current schema on its own.
+	for i, u := range s.Updates {
+		text, ok := texts[u.Source]
+		if !ok {
+			t.Logf("Skipping version %d (%s): no schema text", i, u.Source)
+			continue
+		}
+		run(t, fmt.Sprintf("v%d-%.8s", i, u.Source), func(t testing.TB) {
+			checkUpgradeFrom(t, s, text)
+		})
+	}
+	run(t, "current", func(t testing.TB) {
+		checkUpgradeFrom(t, s, "")
+	})
+	if fixtures != nil {
+		for i, seed := range fixtures.Seeds {
+			run(t, fmt.Sprintf("seed%d", i+1), func(t testing.TB) {
+				for _, msg := range checkSeed(t, s, seed) {
+					t.Error(msg)
+				}
+			})
+		}
+	}
+}
+
+// run runs f as a subtest of t with the given name, if t supports subtests,
+// or otherwise calls f with t.
+func run(t testing.TB, name string, f func(testing.TB)) {
+	switch t := t.(type) {
+	case *testing.T:
+		t.Run(name, func(t *testing.T) { f(t) })
+	case *testing.B:
+		t.Run(name, func(b *testing.B) { f(b) })
+	default:
+		f(t)
+	}
+}
+
+// schemaTexts returns a map from digests to the SQL texts of the versions of
+// s, including fixtures. It reports an error if any fixture schema does not
+// match a version.
+func schemaTexts(s *squibble.Schema, fixtures *Fixtures) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, u := range s.Updates {
+		if u.TargetSQL == "" {
+			continue
+		}
+		ds, err := versionDigests(s, u.TargetSQL)
+		if err != nil {
+			return nil, fmt.Errorf("target SQL of %s: %w", u.Target, err)
+		}
+		for _, d := range ds {
+			out[d] = u.TargetSQL
+		}
+	}
+	if fixtures == nil {
+		return out, nil
+	}
+	for i, text := range fixtures.Schemas {
+		ds, err := versionDigests(s, text)
+		if err != nil {
+			return nil, fmt.Errorf("fixture schema %d: %w", i+1, err)
+		} else if len(ds) == 0 {
+			d, _ := squibble.SQLDigestVersion(text, s.DigestVersion)
+			return nil, fmt.Errorf("fixture schema %d: digest %s is not a version of the schema", i+1, d)
+		}
+		for _, d := range ds {
+			out[d] = text
+		}
+	}
+	return out, nil
+}
+
+// versionDigests returns the digests of the schema text that are versions of
+// s. Since the update rules of s may use different digest versions, the
+// digest of text is computed in each of them.
+func versionDigests(s *squibble.Schema, text string) ([]string, error) {
+	cur, err := squibble.SQLDigestVersion(s.Current, s.DigestVersion)
+	if err != nil {
+		return nil, err
+	}
+	versions := []string{cur}
+	for _, u := range s.Updates {
+		versions = append(versions, u.Source, u.Target)
+	}
+	byVersion := make(map[squibble.DigestVersion]string)
+	var out []string
+	for _, v := range versions {
+		dv := squibble.DigestVersionOf(v)
+		d, ok := byVersion[dv]
+		if !ok {
+			d, err = squibble.SQLDigestVersion(text, dv)
+			if err != nil {
+				return nil, err
+			}
+			byVersion[dv] = d
+		}
+		if d == v && !slices.Contains(out, d) {
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
+
+// checkUpgradeFrom initializes an empty database with the schema text, if it
+// is not empty, then applies s to it and validates the result.
+func checkUpgradeFrom(t testing.TB, s *squibble.Schema, text string) {
+	t.Helper()
+	db := openDB(t)
+	if text != "" {
+		initSchema(t, db, s, text)
+	}
+
+	cp := *s
+	cp.Logf = t.Logf
+	if err := cp.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	opts := &squibble.DigestOptions{
+		IgnoreTables: s.IgnoreTables,
+		HistoryTable: s.HistoryTable,
+		TablePrefix:  s.TablePrefix,
+		Version:      s.DigestVersion,
+	}
+	if err := squibble.Validate(t.Context(), db, s.Current, opts); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+}
+
+// initSchema initializes the empty database db with the schema text, managed
+// with the same options as s.
+func initSchema(t testing.TB, db *sql.DB, s *squibble.Schema, text string) {
+	t.Helper()
+	init := &squibble.Schema{
+		Current:       text,
+		IgnoreTables:  s.IgnoreTables,
+		HistoryTable:  s.HistoryTable,
+		TablePrefix:   s.TablePrefix,
+		DigestVersion: s.DigestVersion,
+		Logf:          t.Logf,
+	}
+	if err := init.Apply(t.Context(), db); err != nil {
+		t.Fatalf("Initialize schema: %v", err)
+	}
+}
+
+// dbSeq is used to give each database opened by openDB a unique name.
+var dbSeq atomic.Int64
+
+// openDB opens a new, empty in-memory database that is closed when t ends.
+//
+// The database is discarded when its last connection closes. The pool keeps
+// an idle connection open, with no time limit, so it lasts until db closes.
+func openDB(t testing.TB) *sql.DB {
+	t.Helper()
+	url := fmt.Sprintf("file:squibbletest-%d?mode=memory&cache=shared", dbSeq.Add(1))
+	db, err := sql.Open("sqlite", url)
+	if err != nil {
+		t.Fatalf("Open database: %v", err)
+	}
+	db.SetMaxIdleConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
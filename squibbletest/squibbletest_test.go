@@ -0,0 +1,154 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package squibbletest_test
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/tailscale/squibble"
+	"github.com/tailscale/squibble/squibbletest"
+
+	_ "modernc.org/sqlite"
+)
+
+func mustHash(t *testing.T, text string) string {
+	t.Helper()
+	h, err := squibble.SQLDigest(text)
+	if err != nil {
+		t.Fatalf("SQLDigest failed: %v", err)
+	}
+	return h
+}
+
+func TestCheckUpgradePaths(t *testing.T) {
+	const v1 = `create table foo (x text)`
+	const v2 = `create table foo (x text, y text)`
+	const v3 = `create table foo (x text, y text); create table bar (z integer)`
+
+	s := &squibble.Schema{
+		Current: v3,
+		Updates: []squibble.UpdateRule{{
+			Source: mustHash(t, v1),
+			Target: mustHash(t, v2),
+			Apply:  squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`),
+		}, {
+			Source:    mustHash(t, v2),
+			Target:    mustHash(t, v3),
+			TargetSQL: v3,
+			Apply:     squibble.Exec(`CREATE TABLE bar (z integer)`),
+		}},
+	}
+
+	fsys := fstest.MapFS{
+		"testdata/v1.sql": {Data: []byte(v1)},
+		"testdata/v2.sql": {Data: []byte(v2)},
+	}
+	schemas, err := squibbletest.ReadSchemas(fsys, "testdata/*.sql")
+	if err != nil {
+		t.Fatalf("ReadSchemas: %v", err)
+	}
+	squibbletest.CheckUpgradePaths(t, s, &squibbletest.Fixtures{
+		Schemas: schemas,
+		Seeds: []squibbletest.Seed{{
+			Schema: v1,
+			Data:   []string{`INSERT INTO foo (x) VALUES ('a')`},
+			Checks: []squibbletest.Check{
+				{Query: `SELECT x, y FROM foo`, Want: [][]any{{"a", nil}}},
+				{Query: `SELECT count(*) FROM bar`, Want: [][]any{{0}}},
+			},
+		}},
+	})
+}
+
+// fakeTB is a testing.TB that records failures rather than reporting them,
+// so that tests can check that CheckUpgradePaths reports them.
+type fakeTB struct {
+	testing.TB // for methods not overridden; calls to these go to the real test
+	errs       []string
+}
+
+func (f *fakeTB) Helper()                        {}
+func (f *fakeTB) Logf(string, ...any)            {}
+func (f *fakeTB) Error(args ...any)              { f.errs = append(f.errs, fmt.Sprint(args...)) }
+func (f *fakeTB) Errorf(msg string, args ...any) { f.errs = append(f.errs, fmt.Sprintf(msg, args...)) }
+func (f *fakeTB) Fatal(args ...any)              { f.Error(args...); runtime.Goexit() }
+func (f *fakeTB) Fatalf(msg string, args ...any) { f.Errorf(msg, args...); runtime.Goexit() }
+func (f *fakeTB) Failed() bool                   { return len(f.errs) != 0 }
+
+// checkFails runs CheckUpgradePaths on s with a fake TB, and reports the
+// failures it recorded.
+func checkFails(t *testing.T, s *squibble.Schema, fixtures *squibbletest.Fixtures) []string {
+	t.Helper()
+	ft := &fakeTB{TB: t}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		squibbletest.CheckUpgradePaths(ft, s, fixtures)
+	}()
+	<-done
+	return ft.errs
+}
+
+func TestCheckUpgradePathsFails(t *testing.T) {
+	const v1 = `create table foo (x text)`
+	const v2 = `create table foo (x text, y text)`
+
+	rule := squibble.UpdateRule{
+		Source:    mustHash(t, v1),
+		Target:    mustHash(t, v2),
+		TargetSQL: v2,
+		Apply:     squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`, `UPDATE foo SET y = x`),
+	}
+	fixtures := &squibbletest.Fixtures{Schemas: []string{v1}}
+
+	tests := []struct {
+		name     string
+		s        *squibble.Schema
+		fixtures *squibbletest.Fixtures
+		want     string
+	}{
+		{"Inconsistent", &squibble.Schema{Current: v2, Updates: []squibble.UpdateRule{{
+			Source: rule.Source,
+			Target: mustHash(t, `create table bar (z)`),
+			Apply:  squibble.NoAction,
+		}}}, nil, "Check schema: "},
+		{"Database", &squibble.Schema{Current: v2, Database: "cold", Updates: []squibble.UpdateRule{rule}},
+			nil, `database "cold" is not supported`},
+		{"BadFixture", &squibble.Schema{Current: v2, Updates: []squibble.UpdateRule{rule}},
+			&squibbletest.Fixtures{Schemas: []string{`create table bar (z)`}}, "is not a version of the schema"},
+		{"BadRule", &squibble.Schema{Current: v2, Updates: []squibble.UpdateRule{{
+			Source: rule.Source,
+			Target: rule.Target,
+			Apply:  squibble.Exec(`ALTER TABLE foo ADD COLUMN z text`),
+		}}}, fixtures, "Apply: confirming update"},
+		{"BadSeed", &squibble.Schema{Current: v2, Updates: []squibble.UpdateRule{{
+			Source: rule.Source,
+			Target: rule.Target,
+			Apply:  squibble.Exec(`ALTER TABLE foo ADD COLUMN y text`),
+		}}}, &squibbletest.Fixtures{Seeds: []squibbletest.Seed{{
+			Schema: v1,
+			Data:   []string{`INSERT INTO foo (x) VALUES ('a')`},
+			Checks: []squibbletest.Check{{Query: `SELECT y FROM foo`, Want: [][]any{{"a"}}}},
+		}}}, "check 1 fails after update 1 "},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			errs := checkFails(t, tc.s, tc.fixtures)
+			if len(errs) != 1 || !strings.Contains(errs[0], tc.want) {
+				t.Errorf("CheckUpgradePaths: got failures %q, want one containing %q", errs, tc.want)
+			}
+		})
+	}
+
+	t.Run("OK", func(t *testing.T) {
+		s := &squibble.Schema{Current: v2, Updates: []squibble.UpdateRule{rule}}
+		if errs := checkFails(t, s, fixtures); len(errs) != 0 {
+			t.Errorf("CheckUpgradePaths: unexpected failures: %q", errs)
+		}
+	})
+}
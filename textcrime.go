@@ -10,56 +10,42 @@ import (
 
 	"github.com/creachadair/mds/mdiff"
 	"github.com/creachadair/mds/mstr"
-	"github.com/creachadair/mds/slice"
 )
 
 // diffSchema computes a human-readable summary of the changes to the schema
 // from ar to br, using the normalized form from the SQLite sqlite_schema
 // table.
-func diffSchema(ar, br []schemaRow) string {
-	lhs := make(map[mapKey]schemaRow)
-	for _, r := range ar {
-		lhs[r.mapKey()] = r
-	}
-	rhs := make(map[mapKey]schemaRow)
-	for _, r := range br {
-		rhs[r.mapKey()] = r
-	}
+func diffSchema(ar, br []schemaRow) string { return newSchemaDiff(ar, br).String() }
 
+// String renders a human-readable summary of the changes described by d.
+// It returns "" if d is empty.
+func (d *SchemaDiff) String() string {
+	if d.IsEmpty() {
+		return ""
+	}
 	var sb strings.Builder
-	for _, r := range ar {
-		o, ok := rhs[r.mapKey()]
-		if !ok {
-			fmt.Fprintf(&sb, "\n>> Remove %s %q\n", r.Type, r.Name)
-			continue
-		}
-
-		// Indices and views do not have columns, so diff those using their
-		// normalized SQL representation.
-		if len(r.Columns) == 0 && len(o.Columns) == 0 {
-			if cleanSQL(r.SQL) == cleanSQL(o.SQL) {
-				continue
-			}
-			sd := mdiff.New(cleanLines(r.SQL), cleanLines(o.SQL)).AddContext(2).Unify()
+	for _, r := range d.Removed {
+		fmt.Fprintf(&sb, "\n>> Remove %s %q\n", r.Type, r.Name)
+	}
+	for _, m := range d.Modified {
+		if len(m.Columns) == 0 && len(m.AddedConstraints) == 0 && len(m.RemovedConstraints) == 0 {
+			sd := mdiff.New(cleanLines(m.OldSQL), cleanLines(m.NewSQL)).AddContext(2).Unify()
 			if len(sd.Edits) != 0 {
-				fmt.Fprintf(&sb, "\n>> Modify %s %q\n", r.Type, r.Name)
+				fmt.Fprintf(&sb, "\n>> Modify %s %q\n", m.Type, m.Name)
 				sd.Format(&sb, mdiff.Unified, nil)
 			}
 			continue
 		}
-
-		// For tables, diff the columns (this requires that they are already sorted).
-		dc := slice.EditScript(r.Columns, o.Columns)
-		if len(dc) == 0 {
-			continue // no difference
+		fmt.Fprintf(&sb, "\n>> Modify %s %q\n", m.Type, m.Name)
+		formatColumns(&sb, m.Columns)
+		for _, c := range m.RemovedConstraints {
+			fmt.Fprintf(&sb, " - remove %s\n", c)
 		}
-		fmt.Fprintf(&sb, "\n>> Modify %s %q\n", r.Type, r.Name)
-		diffColumns(&sb, dc, r.Columns, o.Columns)
-	}
-	for _, r := range br {
-		if _, ok := lhs[r.mapKey()]; ok {
-			continue // we already dealt with this above
+		for _, c := range m.AddedConstraints {
+			fmt.Fprintf(&sb, " + add %s\n", c)
 		}
+	}
+	for _, r := range d.Added {
 		fmt.Fprintf(&sb, "\n>> Add %s %q\n", r.Type, r.Name)
 		if r.SQL != "" {
 			indentLines(&sb, "+", r.SQL)
@@ -75,21 +61,15 @@ func indentLines(w io.Writer, indent, text string) {
 	}
 }
 
-func diffColumns(w io.Writer, dc []slice.Edit[schemaCol], lhs, rhs []schemaCol) {
-	for _, e := range dc {
-		switch e.Op {
-		case slice.OpCopy:
-			for _, col := range e.Y {
-				fmt.Fprintf(w, " + add column %v\n", col)
-			}
-		case slice.OpReplace:
-			for i, old := range e.X {
-				fmt.Fprintf(w, " ! replace column %v\n   with %v\n", old, e.Y[i])
-			}
-		case slice.OpDrop:
-			for _, col := range e.X {
-				fmt.Fprintf(w, " - remove column %v\n", col)
-			}
+func formatColumns(w io.Writer, cc []ColumnChange) {
+	for _, c := range cc {
+		switch {
+		case c.Old == nil:
+			fmt.Fprintf(w, " + add column %v\n", c.New)
+		case c.New == nil:
+			fmt.Fprintf(w, " - remove column %v\n", c.Old)
+		default:
+			fmt.Fprintf(w, " ! replace column %v\n   with %v\n", c.Old, c.New)
 		}
 	}
 }
@@ -107,3 +87,14 @@ func cleanLines(s string) []string {
 // cleanSQL returns a "clean" copy of s, in which leading and trailing
 // whitespace on each line has been removed.
 func cleanSQL(s string) string { return strings.Join(cleanLines(s), " ") }
+
+// dumpSchema renders the SQL definitions of the objects in sr, one per line.
+func dumpSchema(sr []schemaRow) string {
+	var lines []string
+	for _, r := range sr {
+		if r.SQL != "" {
+			lines = append(lines, cleanSQL(r.SQL)+";")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
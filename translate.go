@@ -0,0 +1,105 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package squibble
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+// TranslateHistory rewrites the digests recorded in the history of db that
+// were computed by a digest version other than the DigestVersion of s, to the
+// digests of the same schemas in that version. It reports the number of
+// records translated, and the number that could not be translated because
+// the text of their schema is not known.
+//
+// The text of a schema is known if it is recorded in the history, or if its
+// digest matches the current schema or the TargetSQL of an update rule of s.
+// In addition, a record whose digest matches the current schema of db is
+// translated by computing the digest of db in the new version.
+//
+// Translating the history is not necessary for Apply to work, but it makes
+// the history consistent with digests reported by the current version.
+func (s *Schema) TranslateHistory(ctx context.Context, db *sql.DB) (translated, unknown int, err error) {
+	if err := s.Check(); err != nil {
+		return 0, 0, err
+	}
+	opts := s.digestOptions()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	hr, err := ReadHistory(ctx, tx, opts)
+	if err != nil {
+		return 0, 0, fmt.Errorf("reading update history: %w", err)
+	}
+
+	// Cache the translations, since the same digests recur in the history.
+	dbDigests := make(map[DigestVersion]string)
+	dbDigest := func(v DigestVersion) (string, error) {
+		if d, ok := dbDigests[v]; ok {
+			return d, nil
+		}
+		vopts := *opts
+		vopts.Version = v
+		d, err := DBDigest(ctx, tx, &vopts)
+		dbDigests[v] = d
+		return d, err
+	}
+	newDigests := make(map[string]string)
+	translate := func(h HistoryRow) (string, error) {
+		if d, ok := newDigests[h.Digest]; ok {
+			return d, nil
+		}
+		text := h.Schema
+		if text == "" {
+			text = s.schemaText(ctx, tx, h.Digest)
+		}
+		if text != "" {
+			d, err := SQLDigestVersion(text, opts.version())
+			newDigests[h.Digest] = d
+			return d, err
+		}
+		if cur, err := dbDigest(DigestVersionOf(h.Digest)); err != nil {
+			return "", err
+		} else if cur == h.Digest {
+			d, err := dbDigest(opts.version())
+			newDigests[h.Digest] = d
+			return d, err
+		}
+		newDigests[h.Digest] = ""
+		return "", nil
+	}
+
+	update := fmt.Sprintf(`UPDATE %s SET digest = ? WHERE timestamp = ?`, opts.historyTableRef())
+	for _, h := range hr {
+		if DigestVersionOf(h.Digest) == opts.version() {
+			continue
+		}
+		d, err := translate(h)
+		if err != nil {
+			return 0, 0, fmt.Errorf("translate digest %s: %w", h.Digest, err)
+		} else if d == "" {
+			s.log(ctx, slog.LevelWarn, "schema text unknown; digest not translated",
+				fmt.Sprintf("Schema text for digest %s is unknown; not translated", h.Digest), slog.String("digest", h.Digest))
+			unknown++
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, update, d, h.Timestamp.UnixMicro()); err != nil {
+			return 0, 0, fmt.Errorf("update history: %w", err)
+		}
+		translated++
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	s.log(ctx, slog.LevelInfo, "translated schema history",
+		fmt.Sprintf("Translated %d schema history records (%d unknown)", translated, unknown),
+		slog.Int("count", translated), slog.Int("unknown", unknown))
+	return translated, unknown, nil
+}
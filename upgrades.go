@@ -6,14 +6,29 @@ package squibble
 import (
 	"context"
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/creachadair/mds/mapset"
 )
 
 // Exec returns an [UpdateRule] apply function that executes the specified
 // statements sequentially.
+//
+// A PRAGMA foreign_key_check statement fails with an error of concrete type
+// [ForeignKeyError] if it reports any violations, rather than discarding
+// them as the results of other statements are discarded.
 func Exec(stmts ...string) func(context.Context, DBConn) error {
 	return func(ctx context.Context, db DBConn) error {
 		for i, stmt := range stmts {
-			if _, err := db.ExecContext(ctx, stmt); err != nil {
+			var err error
+			if isForeignKeyCheck(stmt) {
+				err = foreignKeyCheck(ctx, db, stmt)
+			} else {
+				_, err = db.ExecContext(ctx, stmt)
+			}
+			if err != nil {
 				return fmt.Errorf("stmt %d: %w", i+1, err)
 			}
 		}
@@ -21,5 +36,220 @@ func Exec(stmts ...string) func(context.Context, DBConn) error {
 	}
 }
 
+// isForeignKeyCheck reports whether stmt is a PRAGMA foreign_key_check
+// statement, optionally qualified by a schema name.
+func isForeignKeyCheck(stmt string) bool {
+	toks := sqlTokens(stmt)
+	if len(toks) < 2 || !strings.EqualFold(toks[0], "PRAGMA") {
+		return false
+	} else if len(toks) >= 4 && toks[2] == "." {
+		toks = toks[2:]
+	}
+	return strings.EqualFold(toks[1], "foreign_key_check")
+}
+
 // NoAction is a no-op update action.
 func NoAction(context.Context, DBConn) error { return nil }
+
+// RebuildTable returns an [UpdateRule] apply function that replaces the
+// definition of the specified table with newCreateSQL, following the procedure
+// described in https://sqlite.org/lang_altertable.html#otheralter. This
+// permits changes that ALTER TABLE cannot make in place, such as changing the
+// type or constraints of an existing column.
+//
+// The newCreateSQL must be a CREATE TABLE statement for the table. The name
+// given in the statement is ignored. Rows are copied from the old table to the
+// new one according to columnMap, which maps the name of each column of the new
+// table to a SQL expression over the columns of the old table. If columnMap is
+// nil, each column of the new table is copied from the column of the same name
+// in the old table, if there is one.
+//
+// The indexes and triggers belonging to the table are re-created after the
+// new table is in place, as are any other views and triggers whose
+// definitions refer to the table, which must be dropped temporarily to rename
+// the new table. Finally, the apply function checks the foreign key
+// constraints of the table, and reports an error of concrete type
+// [ForeignKeyError] if any are violated.
+//
+// The table is rebuilt in the database managed by the [Schema] applying the
+// update (see its Database field), or in the main database if the apply
+// function is called outside a Schema.
+//
+// Note that if foreign key enforcement is enabled, dropping the old table may
+// cascade to other tables that refer to it. Set DisableForeignKeys on the
+// [Schema] to prevent this.
+func RebuildTable(table, newCreateSQL string, columnMap map[string]string) func(context.Context, DBConn) error {
+	return func(ctx context.Context, db DBConn) error {
+		database := contextOptions(ctx).database()
+		qualified := func(name string) string { return quoteIdent(database) + "." + quoteIdent(name) }
+		tmp := "_squibble_new_" + table
+		create, ok := renameCreateTable(newCreateSQL, qualified(tmp))
+		if !ok {
+			return fmt.Errorf("rebuild %q: invalid CREATE TABLE statement", table)
+		}
+
+		// Save and drop the views and triggers, and save the indexes on the table.
+		saved, err := readRebuildObjects(ctx, db, database, table)
+		if err != nil {
+			return fmt.Errorf("rebuild %q: %w", table, err)
+		}
+		for _, obj := range saved {
+			if obj.Type == "index" {
+				continue // these will be dropped with the table
+			}
+			drop := fmt.Sprintf(`DROP %s IF EXISTS %s`, strings.ToUpper(obj.Type), qualified(obj.Name))
+			if _, err := db.ExecContext(ctx, drop); err != nil {
+				return fmt.Errorf("rebuild %q: drop %s %q: %w", table, obj.Type, obj.Name, err)
+			}
+		}
+
+		// Create the new table and copy the rows from the old table.
+		if _, err := db.ExecContext(ctx, create); err != nil {
+			return fmt.Errorf("rebuild %q: create new table: %w", table, err)
+		}
+		if columnMap == nil {
+			columnMap, err = commonColumns(ctx, db, database, table, tmp)
+			if err != nil {
+				return fmt.Errorf("rebuild %q: %w", table, err)
+			}
+		}
+		if len(columnMap) != 0 {
+			var dst, src []string
+			for _, col := range slices.Sorted(maps.Keys(columnMap)) {
+				dst = append(dst, quoteIdent(col))
+				src = append(src, columnMap[col])
+			}
+			stmt := fmt.Sprintf(`INSERT INTO %s (%s) SELECT %s FROM %s`,
+				qualified(tmp), strings.Join(dst, ", "), strings.Join(src, ", "), qualified(table))
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("rebuild %q: copy rows: %w", table, err)
+			}
+		}
+
+		// Replace the old table with the new one, and restore the other objects.
+		if _, err := db.ExecContext(ctx, fmt.Sprintf(`DROP TABLE %s`, qualified(table))); err != nil {
+			return fmt.Errorf("rebuild %q: drop old table: %w", table, err)
+		}
+		rename := fmt.Sprintf(`ALTER TABLE %s RENAME TO %s`, qualified(tmp), quoteIdent(table))
+		if _, err := db.ExecContext(ctx, rename); err != nil {
+			return fmt.Errorf("rebuild %q: rename new table: %w", table, err)
+		}
+		for _, obj := range saved {
+			stmt := obj.SQL
+			if database != "main" {
+				stmt, err = qualifyCreate(stmt, database)
+				if err != nil {
+					return fmt.Errorf("rebuild %q: restore %s %q: %w", table, obj.Type, obj.Name, err)
+				}
+			}
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("rebuild %q: restore %s %q: %w", table, obj.Type, obj.Name, err)
+			}
+		}
+		return checkForeignKeys(ctx, db, database, table)
+	}
+}
+
+// readRebuildObjects reads the indexes belonging to table in the named
+// database, and the views and triggers whose definitions refer to the table,
+// or to one of those views, in order of creation.
+func readRebuildObjects(ctx context.Context, db DBConn, database, table string) ([]schemaRow, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`SELECT type, name, tbl_name, sql FROM %s.sqlite_schema
+  WHERE sql IS NOT NULL AND type IN ('index', 'view', 'trigger') ORDER BY rowid`, quoteIdent(database)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var all []schemaRow
+	for rows.Next() {
+		var r schemaRow
+		if err := rows.Scan(&r.Type, &r.Name, &r.TableName, &r.SQL); err != nil {
+			return nil, fmt.Errorf("scan schema: %w", err)
+		}
+		all = append(all, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return dependentObjects(all, table), nil
+}
+
+// dependentObjects returns the rows of all that depend on any of the named
+// tables: The indexes belonging to the tables, and the views and triggers
+// whose definitions refer to the tables, or to one of those views, in their
+// original order.
+func dependentObjects(all []schemaRow, tables ...string) []schemaRow {
+	// A view that refers to a table must be dropped, and so must the views
+	// and triggers that refer to that view, and so on. SQLite names are not
+	// case-sensitive.
+	names := mapset.New[string]()
+	for _, t := range tables {
+		names.Add(strings.ToLower(t))
+	}
+	owned := func(r schemaRow) bool {
+		return slices.ContainsFunc(tables, func(t string) bool { return strings.EqualFold(r.TableName, t) })
+	}
+	refers := func(r schemaRow) bool {
+		if r.Type == "index" || owned(r) {
+			return owned(r)
+		}
+		return slices.ContainsFunc(sqlTokens(r.SQL), func(tok string) bool {
+			return names.Has(strings.ToLower(unquoteIdent(tok)))
+		})
+	}
+	keep := make([]bool, len(all))
+	for changed := true; changed; {
+		changed = false
+		for i, r := range all {
+			if !keep[i] && refers(r) {
+				keep[i], changed = true, true
+				if r.Type == "view" {
+					names.Add(strings.ToLower(r.Name))
+				}
+			}
+		}
+	}
+	var out []schemaRow
+	for i, r := range all {
+		if keep[i] {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// commonColumns returns a column map from each non-generated column of table
+// dst to the column of the same name in table src, both in the named
+// database, where one exists.
+func commonColumns(ctx context.Context, db DBConn, database, src, dst string) (map[string]string, error) {
+	scols, err := readColumns(ctx, db, database, src)
+	if err != nil {
+		return nil, err
+	}
+	dcols, err := readColumns(ctx, db, database, dst)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]string)
+	for _, d := range dcols {
+		if d.Hidden != 0 {
+			continue
+		}
+		if slices.ContainsFunc(scols, func(s schemaCol) bool { return s.Name == d.Name && s.Hidden == 0 }) {
+			out[d.Name] = quoteIdent(d.Name)
+		}
+	}
+	return out, nil
+}
+
+// renameCreateTable rewrites a CREATE TABLE statement to create a table with
+// the given quoted name, which may be qualified by a database name. It reports
+// false if stmt is not a CREATE TABLE statement.
+func renameCreateTable(stmt, name string) (string, bool) {
+	head, rest, ok := strings.Cut(stmt, "(")
+	if f := strings.Fields(strings.ToUpper(head)); !ok || len(f) < 2 || f[0] != "CREATE" || f[1] != "TABLE" {
+		return "", false
+	}
+	return fmt.Sprintf("CREATE TABLE %s (%s", name, rest), true
+}
@@ -19,21 +19,36 @@ import (
 // An error reported by Validate has concrete type [ValidationError] if the
 // schemas differ. A nil opts is valid and provides default options.
 func Validate(ctx context.Context, db DBConn, schema string, opts *DigestOptions) error {
-	comp, err := schemaTextToRows(ctx, schema)
+	diff, err := DiffDB(ctx, db, schema, opts)
 	if err != nil {
 		return err
+	} else if !diff.IsEmpty() {
+		return ValidationError{Diff: diff.String(), Changes: diff}
 	}
-	main, err := readSchema(ctx, db, "main", opts)
+	return nil
+}
+
+func schemaTextToRows(ctx context.Context, schema string, v DigestVersion) ([]schemaRow, error) {
+	vdb, err := sql.Open("sqlite", "file::memory:")
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("create validation db: %w", err)
 	}
-	if diff := diffSchema(main, comp); diff != "" {
-		return ValidationError{Diff: diff}
+	defer vdb.Close()
+	tx, err := vdb.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, schema); err != nil {
+		return nil, fmt.Errorf("compile schema: %w", err)
+	}
+	return readSchema(ctx, tx, &DigestOptions{Version: v})
 }
 
-func schemaTextToRows(ctx context.Context, schema string) ([]schemaRow, error) {
+// qualifiedSchema returns statements that create the tables, indexes, views,
+// and triggers defined by the schema text in the specified database, in the
+// order of their definition.
+func qualifiedSchema(ctx context.Context, schema, database string) ([]string, error) {
 	vdb, err := sql.Open("sqlite", "file::memory:")
 	if err != nil {
 		return nil, fmt.Errorf("create validation db: %w", err)
@@ -47,7 +62,39 @@ func schemaTextToRows(ctx context.Context, schema string) ([]schemaRow, error) {
 	if _, err := tx.ExecContext(ctx, schema); err != nil {
 		return nil, fmt.Errorf("compile schema: %w", err)
 	}
-	return readSchema(ctx, tx, "main", nil)
+	rows, err := tx.QueryContext(ctx, `SELECT sql FROM sqlite_schema WHERE sql IS NOT NULL ORDER BY rowid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []string
+	for rows.Next() {
+		var stmt string
+		if err := rows.Scan(&stmt); err != nil {
+			return nil, fmt.Errorf("scan schema: %w", err)
+		}
+		q, err := qualifyCreate(stmt, database)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, q)
+	}
+	return out, rows.Err()
+}
+
+// qualifyCreate rewrites stmt, a CREATE statement as recorded by SQLite in
+// the sqlite_schema table, to create its object in the specified database.
+func qualifyCreate(stmt, database string) (string, error) {
+	// SQLite normalizes the beginning of each statement, so the name of the
+	// object directly follows these keywords.
+	heads := []string{"CREATE TABLE ", "CREATE VIRTUAL TABLE ", "CREATE INDEX ",
+		"CREATE UNIQUE INDEX ", "CREATE VIEW ", "CREATE TRIGGER "}
+	i := slices.IndexFunc(heads, func(h string) bool { return strings.HasPrefix(stmt, h) })
+	if i < 0 {
+		return "", fmt.Errorf("unrecognized schema statement %q", stmt)
+	}
+	return heads[i] + quoteIdent(database) + "." + stmt[len(heads[i]):], nil
 }
 
 // ValidationError is the concrete type of errors reported by the [Validate]
@@ -56,6 +103,10 @@ type ValidationError struct {
 	// Diff is a human readable summary of the difference between what was in
 	// the database (-lhs) and the expected schema (+rhs).
 	Diff string
+
+	// Changes is a structured description of the same differences reported
+	// by Diff.
+	Changes *SchemaDiff
 }
 
 func (v ValidationError) Error() string {
@@ -72,6 +123,10 @@ type schemaRow struct {
 	TableName string      // affiliated table name (== Name for tables and views)
 	Columns   []schemaCol // for tables, the columns
 	SQL       string      // the text of the definition (maybe)
+
+	// For tables, the canonical forms of constraints and table options not
+	// described by the columns, sorted (DigestV2 and later).
+	Constraints []string `json:",omitzero"`
 }
 
 type mapKey struct {
@@ -91,23 +146,8 @@ type schemaCol struct {
 	Default    any    // the default value
 	PrimaryKey bool   // whether this column is part of the primary key
 	Hidden     int    // 0=normal, 1=hidden, 2=generated virtual, 3=generated stored
-}
 
-func (c schemaCol) String() string {
-	var sb strings.Builder
-	fmt.Fprintf(&sb, "%q %s", c.Name, c.Type)
-	if c.NotNull {
-		fmt.Fprint(&sb, " not null")
-	} else {
-		fmt.Fprint(&sb, " null")
-	}
-	if c.Default != nil {
-		fmt.Fprintf(&sb, " default=%v", c.Default)
-	}
-	if c.PrimaryKey {
-		fmt.Fprint(&sb, " primary key")
-	}
-	return sb.String()
+	Collate string `json:",omitzero"` // the collation, if not BINARY (DigestV2 and later)
 }
 
 func compareSchemaRows(a, b schemaRow) int {
@@ -128,8 +168,8 @@ func compareSchemaCols(a, b schemaCol) int {
 		return v
 	}
 	return cmp.Compare(
-		fmt.Sprintf("%v %v %v %d", a.NotNull, a.PrimaryKey, a.Default != nil, a.Hidden),
-		fmt.Sprintf("%v %v %v %d", b.NotNull, b.PrimaryKey, b.Default != nil, b.Hidden),
+		fmt.Sprintf("%v %v %v %d %s", a.NotNull, a.PrimaryKey, a.Default != nil, a.Hidden, a.Collate),
+		fmt.Sprintf("%v %v %v %d %s", b.NotNull, b.PrimaryKey, b.Default != nil, b.Hidden, b.Collate),
 	)
 }
 
@@ -140,17 +180,20 @@ type DBConn interface {
 	ExecContext(context.Context, string, ...any) (sql.Result, error)
 }
 
-// readSchema reads the schema for the specified database and returns the
+// readSchema reads the schema for the database named by opts and returns the
 // resulting rows sorted into a stable order. Rows belonging to the history
 // table and any affiliated indices are filtered out.
-func readSchema(ctx context.Context, db DBConn, root string, opts *DigestOptions) ([]schemaRow, error) {
+func readSchema(ctx context.Context, db DBConn, opts *DigestOptions) ([]schemaRow, error) {
 	// Skip the history and sequence tables and their indices, along with any
-	// additional tables and views recorded in the options.
+	// additional tables and views recorded in the options, and any that do not
+	// have the required prefix.
 	ignore := mapset.New(opts.ignoreTables()...)
-	ignore.Add("_schema_history", "sqlite_sequence")
+	ignore.Add(opts.historyTable(), "sqlite_sequence")
+	prefix := opts.tablePrefix()
+	root := opts.database()
 
 	rows, err := db.QueryContext(ctx,
-		fmt.Sprintf(`SELECT type, name, tbl_name, sql FROM %s.sqlite_schema`, root),
+		fmt.Sprintf(`SELECT type, name, tbl_name, sql FROM %s.sqlite_schema`, quoteIdent(root)),
 	)
 	if err != nil {
 		return nil, err
@@ -162,7 +205,7 @@ func readSchema(ctx context.Context, db DBConn, root string, opts *DigestOptions
 		var sql sql.NullString
 		if err := rows.Scan(&rtype, &name, &tblName, &sql); err != nil {
 			return nil, fmt.Errorf("scan %s schema: %w", root, err)
-		} else if ignore.Has(tblName) {
+		} else if ignore.Has(tblName) || !strings.HasPrefix(tblName, prefix) {
 			continue // see above
 		} else if strings.HasPrefix(name, "sqlite_autoindex_") {
 			continue // skip auto-generates SQLite indices
@@ -176,6 +219,11 @@ func readSchema(ctx context.Context, db DBConn, root string, opts *DigestOptions
 				return nil, err
 			}
 			out[len(out)-1].Columns = cols
+			if opts.version() >= DigestV2 {
+				if err := readConstraints(ctx, db, root, &out[len(out)-1]); err != nil {
+					return nil, err
+				}
+			}
 		}
 	}
 	slices.SortFunc(out, compareSchemaRows)
@@ -184,7 +232,7 @@ func readSchema(ctx context.Context, db DBConn, root string, opts *DigestOptions
 
 // readColumns reads the schema metadata for the columns of the specified table.
 func readColumns(ctx context.Context, db DBConn, root, table string) ([]schemaCol, error) {
-	rows, err := db.QueryContext(ctx, fmt.Sprintf(`PRAGMA %s.table_xinfo('%s')`, root, table))
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`PRAGMA %s.table_xinfo('%s')`, quoteIdent(root), table))
 	if err != nil {
 		return nil, err
 	}
@@ -211,13 +259,13 @@ func readColumns(ctx context.Context, db DBConn, root, table string) ([]schemaCo
 	return out, nil
 }
 
-// schemaIsEmpty reports whether the schema for the specified database is
+// schemaIsEmpty reports whether the schema for the database named by opts is
 // essentially empty (meaning, it is either empty or contains only a history
-// table).
-func schemaIsEmpty(ctx context.Context, db DBConn, root string) bool {
-	main, err := readSchema(ctx, db, root, nil)
+// table and tables ignored by opts).
+func schemaIsEmpty(ctx context.Context, db DBConn, opts *DigestOptions) bool {
+	main, err := readSchema(ctx, db, opts)
 	if err != nil {
 		return false
 	}
-	return len(main) == 0 || (len(main) == 1 && main[0].Name == historyTableName)
+	return len(main) == 0
 }